@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API is written, when enabled, to api/v1/ in the output directory:
+//
+//	repos.json                 APIRepoList
+//	<repo>/repo.json           APIRepo
+//	<repo>/commits/<page>.json APICommitList, paged by logPageSize from 1
+//	<repo>/commit/<id>.json    APICommitDetail
+//
+// Every document has a version field holding apiVersion. Within a version,
+// fields may be added but are never removed or given a different meaning;
+// incompatible changes are written to a new directory with a new version.
+// Times are in RFC 3339 format.
+const apiVersion = 1
+
+// APIRepoList is the list of all repos.
+type APIRepoList struct {
+	Version int              `json:"version"`
+	Repos   []APIRepoSummary `json:"repos"`
+}
+
+// APIRepoSummary describes a repo in the repo list. Pin is the position of the
+// repo in the pinned list, or -1 if it isn't pinned.
+type APIRepoSummary struct {
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	LastCommit     string    `json:"lastCommit"`
+	LastCommitTime time.Time `json:"lastCommitTime"`
+	Pin            int       `json:"pin"`
+}
+
+// APIPerson is the author or committer of a commit, or the tagger of a tag.
+type APIPerson struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Time  time.Time `json:"time"`
+}
+
+// APICommit is a single commit.
+type APICommit struct {
+	ID        string    `json:"id"`
+	Tree      string    `json:"tree"`
+	Parents   []string  `json:"parents"`
+	Author    APIPerson `json:"author"`
+	Committer APIPerson `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// APITag is a tag that points to a commit. Tagger and Message are only set
+// for annotated tags.
+type APITag struct {
+	Name    string     `json:"name"`
+	ID      string     `json:"id"`
+	Commit  string     `json:"commit"`
+	Tagger  *APIPerson `json:"tagger,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// APIRepo describes a repo along with the tree of its latest commit.
+type APIRepo struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Head        APICommit `json:"head"`
+	Tags        []APITag  `json:"tags"`
+	Tree        *APIDir   `json:"tree"`
+}
+
+// APIDir is a directory in a tree. LastCommit is the ID of the last commit to
+// change anything within the directory, and Size is the total size of the
+// files within it.
+type APIDir struct {
+	ID         string             `json:"id"`
+	Path       string             `json:"path"`
+	LastCommit string             `json:"lastCommit"`
+	FileCount  int                `json:"fileCount"`
+	Size       int64              `json:"size"`
+	Dirs       map[string]*APIDir `json:"dirs"`
+	Files      map[string]APIFile `json:"files"`
+}
+
+// APIFile is a file in a tree. Raw, Pretty and History are the paths, relative
+// to the repo directory, of the pages for the file when they are being built.
+// Link is only set for symbolic links, and is the target of the link.
+type APIFile struct {
+	Path       string `json:"path"`
+	LastCommit string `json:"lastCommit"`
+	Size       int64  `json:"size"`
+	Link       string `json:"link,omitempty"`
+	Raw        string `json:"raw,omitempty"`
+	Pretty     string `json:"pretty,omitempty"`
+	History    string `json:"history,omitempty"`
+}
+
+// APICommitList is a page of commits, newest first.
+type APICommitList struct {
+	Version int         `json:"version"`
+	Page    int         `json:"page"`
+	Pages   int         `json:"pages"`
+	Commits []APICommit `json:"commits"`
+}
+
+// APICommitDetail is a commit along with the changes it made to its first
+// parent.
+type APICommitDetail struct {
+	Version int             `json:"version"`
+	Commit  APICommit       `json:"commit"`
+	Added   int             `json:"added"`
+	Deleted int             `json:"deleted"`
+	Files   []APIFileChange `json:"files"`
+}
+
+// APIFileChange is a change to a single file. Type is one of added, deleted,
+// modified, typechanged, renamed or copied, with OldPath and Similarity only
+// being set for the last two.
+type APIFileChange struct {
+	Type       string `json:"type"`
+	Path       string `json:"path"`
+	OldPath    string `json:"oldPath,omitempty"`
+	OldID      string `json:"oldID,omitempty"`
+	NewID      string `json:"newID,omitempty"`
+	Similarity int    `json:"similarity,omitempty"`
+	Binary     bool   `json:"binary"`
+	Added      int    `json:"added"`
+	Deleted    int    `json:"deleted"`
+}
+
+func apiPath(elems ...string) string {
+	return filepath.Join(append([]string{config.OutputDir, "api", "v" + strconv.Itoa(apiVersion)}, elems...)...)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", path, err)
+	}
+
+	return writeIfChanged(path, append(data, '\n'))
+}
+
+func apiCommit(c *Commit) APICommit {
+	parents := c.Parents
+	if parents == nil {
+		parents = []string{}
+	}
+
+	return APICommit{
+		ID:        c.ID,
+		Tree:      c.Tree,
+		Parents:   parents,
+		Author:    APIPerson{Name: c.Author, Email: c.AuthorEmail, Time: c.AuthorTime},
+		Committer: APIPerson{Name: c.Committer, Email: c.CommitterEmail, Time: c.Time},
+		Message:   c.Msg,
+	}
+}
+
+func commitID(c *Commit) string {
+	if c == nil {
+		return ""
+	}
+
+	return c.ID
+}
+
+func apiDir(d *Dir) *APIDir {
+	path := strings.Join(d.Path, "")
+	a := &APIDir{
+		ID:         d.ID,
+		Path:       strings.TrimSuffix(path, "/"),
+		LastCommit: commitID(d.Commit),
+		FileCount:  d.FileCount,
+		Size:       d.Size,
+		Dirs:       make(map[string]*APIDir, len(d.Dirs)),
+		Files:      make(map[string]APIFile, len(d.Files)),
+	}
+
+	for name, sub := range d.Dirs {
+		a.Dirs[name] = apiDir(sub)
+	}
+
+	for name, f := range d.Files {
+		a.Files[name] = APIFile{
+			Path:       path + name,
+			LastCommit: commitID(f.Commit),
+			Size:       f.Size,
+			Link:       f.Link,
+			Raw:        f.RawPath,
+			Pretty:     f.PrettyPath,
+			History:    f.History,
+		}
+	}
+
+	return a
+}
+
+func buildAPIRepoList(repos []RepoData) error {
+	list := APIRepoList{
+		Version: apiVersion,
+		Repos:   make([]APIRepoSummary, len(repos)),
+	}
+
+	for n, r := range repos {
+		list.Repos[n] = APIRepoSummary{
+			Name:           r.Name,
+			Description:    r.Desc,
+			LastCommit:     r.LastCommit,
+			LastCommitTime: r.LastCommitTime,
+			Pin:            r.Pin,
+		}
+	}
+
+	return writeJSON(apiPath("repos.json"), list)
+}
+
+// apiStale returns true when the repo document is missing or was written for
+// a different commit, its time being set to that of the commit it describes.
+func apiStale(repo string, latest *Commit) (bool, error) {
+	fi, err := os.Stat(apiPath(repo, "repo.json"))
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error stat'ing API repo file: %w", err)
+	}
+
+	return !fi.ModTime().Equal(latest.Time), nil
+}
+
+// buildAPI writes the JSON documents for a repo, with commits being its full
+// history.
+func buildAPI(repo string, r *Repo, info RepoInfo, commits []*Commit) error {
+	if err := os.MkdirAll(apiPath(repo, "commit"), 0o755); err != nil {
+		return fmt.Errorf("error creating API directory: %w", err)
+	}
+
+	doc := APIRepo{
+		Version:     apiVersion,
+		Name:        info.Name,
+		Description: info.Desc,
+		Head:        apiCommit(info.Commit),
+		Tags:        make([]APITag, len(info.Tags)),
+		Tree:        apiDir(info.Root),
+	}
+
+	for n, t := range info.Tags {
+		doc.Tags[n] = APITag{
+			Name:   t.Name,
+			ID:     t.ID,
+			Commit: t.Commit.ID,
+		}
+
+		if t.Type == ObjectTag {
+			doc.Tags[n].Tagger = &APIPerson{Name: t.Tagger, Email: t.TaggerEmail, Time: t.Time}
+			doc.Tags[n].Message = t.Msg
+		}
+	}
+
+	if err := buildAPICommitLists(repo, commits); err != nil {
+		return err
+	}
+
+	dir := apiPath(repo, "commit")
+	wanted := make(map[string]struct{}, len(commits))
+
+	for _, c := range commits {
+		outpath := filepath.Join(dir, c.ID+".json")
+		wanted[c.ID+".json"] = struct{}{}
+
+		if !force {
+			fi, err := os.Stat(outpath)
+			if err == nil && fi.ModTime().Equal(c.Time) {
+				continue
+			} else if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error stat'ing commit file: %w", err)
+			}
+		}
+
+		if err := buildAPICommit(repo, r, c, outpath); err != nil {
+			return fmt.Errorf("error building commit %s: %w", c.ID, err)
+		}
+	}
+
+	// commits that are no longer in the history, such as after a force push,
+	// have their documents removed
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading API commit directory: %w", err)
+	}
+
+	for _, f := range files {
+		if _, ok := wanted[f.Name()]; !ok && strings.HasSuffix(f.Name(), ".json") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return fmt.Errorf("error removing old commit file: %w", err)
+			}
+		}
+	}
+
+	// the repo document is written last, so that a failure above leaves it
+	// stale and the next build tries again
+	path := apiPath(repo, "repo.json")
+
+	if err := writeJSON(path, doc); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(path, info.Commit.Time, info.Commit.Time); err != nil {
+		return fmt.Errorf("error setting API repo file time: %w", err)
+	}
+
+	return nil
+}
+
+func buildAPICommitLists(repo string, commits []*Commit) error {
+	dir := apiPath(repo, "commits")
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating API directory: %w", err)
+	}
+
+	pageSize := config.LogPageSize
+	if pageSize <= 0 {
+		pageSize = len(commits)
+	}
+
+	pages := (len(commits) + pageSize - 1) / pageSize
+	wanted := make(map[string]struct{}, pages)
+
+	for page := 1; page <= pages; page++ {
+		start := (page - 1) * pageSize
+		end := start + pageSize
+
+		if end > len(commits) {
+			end = len(commits)
+		}
+
+		list := APICommitList{
+			Version: apiVersion,
+			Page:    page,
+			Pages:   pages,
+			Commits: make([]APICommit, 0, end-start),
+		}
+
+		for _, c := range commits[start:end] {
+			list.Commits = append(list.Commits, apiCommit(c))
+		}
+
+		name := strconv.Itoa(page) + ".json"
+		wanted[name] = struct{}{}
+
+		if err := writeJSON(filepath.Join(dir, name), list); err != nil {
+			return err
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading API directory: %w", err)
+	}
+
+	for _, f := range files {
+		if _, ok := wanted[f.Name()]; !ok {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return fmt.Errorf("error removing old commit page: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func buildAPICommit(repo string, r *Repo, c *Commit, outpath string) error {
+	info, err := getCommitInfo(repo, r, c)
+	if err != nil {
+		return err
+	}
+
+	detail := APICommitDetail{
+		Version: apiVersion,
+		Commit:  apiCommit(c),
+		Added:   info.Added,
+		Deleted: info.Deleted,
+		Files:   make([]APIFileChange, len(info.Files)),
+	}
+
+	for n, f := range info.Files {
+		detail.Files[n] = APIFileChange{
+			Type:    f.Type.String(),
+			Path:    f.Path,
+			OldID:   f.OldID,
+			NewID:   f.NewID,
+			Binary:  f.Binary,
+			Added:   f.Added,
+			Deleted: f.Deleted,
+		}
+
+		if f.Type == ChangeRenamed || f.Type == ChangeCopied {
+			detail.Files[n].OldPath = f.OldPath
+			detail.Files[n].Similarity = f.Similarity
+		}
+	}
+
+	if err := writeJSON(outpath, detail); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(outpath, c.Time, c.Time); err != nil {
+		return fmt.Errorf("error setting API commit file time: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unexpected error decoding %s: %s", path, err)
+	}
+}
+
+func TestAPIDir(t *testing.T) {
+	c := &Commit{ID: testID1}
+	d := &Dir{
+		ID:        testID2,
+		Commit:    c,
+		FileCount: 2,
+		Size:      15,
+		Dirs: map[string]*Dir{
+			"sub": {
+				ID:        testID3,
+				Path:      []string{"sub/"},
+				FileCount: 1,
+				Size:      10,
+				Dirs:      map[string]*Dir{},
+				Files: map[string]*File{
+					"b.txt": {Path: "sub/b.txt", Size: 10, Commit: c, RawPath: "raw/sub/b.txt", PrettyPath: "sub/b.txt.html"},
+				},
+			},
+		},
+		Files: map[string]*File{
+			"link": {Path: "link", Size: 5, Link: "sub/b.txt"},
+		},
+	}
+
+	expected := &APIDir{
+		ID:         testID2,
+		LastCommit: testID1,
+		FileCount:  2,
+		Size:       15,
+		Dirs: map[string]*APIDir{
+			"sub": {
+				ID:        testID3,
+				Path:      "sub",
+				FileCount: 1,
+				Size:      10,
+				Dirs:      map[string]*APIDir{},
+				Files: map[string]APIFile{
+					"b.txt": {Path: "sub/b.txt", LastCommit: testID1, Size: 10, Raw: "raw/sub/b.txt", Pretty: "sub/b.txt.html"},
+				},
+			},
+		},
+		Files: map[string]APIFile{
+			"link": {Path: "link", Size: 5, Link: "sub/b.txt"},
+		},
+	}
+
+	if a := apiDir(d); !reflect.DeepEqual(a, expected) {
+		t.Errorf("expecting %+v, got %+v", expected, a)
+	}
+}
+
+func TestBuildAPICommitLists(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	commits := []*Commit{{ID: testID3}, {ID: testID2, Parents: []string{testID1}}, {ID: testID1}}
+
+	for n, test := range [...]struct {
+		PageSize int
+		Pages    [][]string
+	}{
+		{ // 1
+			PageSize: 0,
+			Pages:    [][]string{{testID3, testID2, testID1}},
+		},
+		{ // 2
+			PageSize: 2,
+			Pages:    [][]string{{testID3, testID2}, {testID1}},
+		},
+		{ // 3
+			PageSize: 1,
+			Pages:    [][]string{{testID3}, {testID2}, {testID1}},
+		},
+	} {
+		config.OutputDir = t.TempDir()
+		config.LogPageSize = test.PageSize
+
+		writeFiles(t, apiPath("repo", "commits"), map[string]string{"4.json": "{}"})
+
+		if err := buildAPICommitLists("repo", commits); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		files, _ := os.ReadDir(apiPath("repo", "commits"))
+
+		if len(files) != len(test.Pages) {
+			t.Errorf("test %d: expecting %d pages, got %d", n+1, len(test.Pages), len(files))
+		}
+
+		for p, ids := range test.Pages {
+			var list APICommitList
+
+			readJSON(t, apiPath("repo", "commits", strconv.Itoa(p+1)+".json"), &list)
+
+			if list.Version != apiVersion || list.Page != p+1 || list.Pages != len(test.Pages) {
+				t.Errorf("test %d: page %d: unexpected header %d %d/%d", n+1, p+1, list.Version, list.Page, list.Pages)
+			}
+
+			var got []string
+
+			for _, c := range list.Commits {
+				got = append(got, c.ID)
+
+				if c.Parents == nil {
+					t.Errorf("test %d: expecting non-nil parents for %s", n+1, c.ID)
+				}
+			}
+
+			if !reflect.DeepEqual(got, ids) {
+				t.Errorf("test %d: page %d: expecting commits %v, got %v", n+1, p+1, ids, got)
+			}
+		}
+	}
+}
+
+func TestBuildAPI(t *testing.T) {
+	gitDir := testGitRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+
+	r := OpenRepo(gitDir)
+
+	commits, err := r.walkLog(testGit(t, gitDir, "rev-parse", "main"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	head := commits[0]
+	info := RepoInfo{
+		Name:   "repo",
+		Desc:   "A repo",
+		Root:   &Dir{ID: head.Tree, Commit: head, Dirs: map[string]*Dir{}, Files: map[string]*File{}},
+		Commit: head,
+	}
+
+	if stale, err := apiStale("repo", head); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !stale {
+		t.Error("expecting missing API to be stale")
+	}
+
+	if err := buildAPI("repo", r, info, commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if stale, err := apiStale("repo", head); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if stale {
+		t.Error("expecting API not to be stale after building")
+	}
+
+	if stale, _ := apiStale("repo", &Commit{Time: head.Time.Add(time.Second)}); !stale {
+		t.Error("expecting API to be stale for a different commit")
+	}
+
+	var doc APIRepo
+
+	readJSON(t, apiPath("repo", "repo.json"), &doc)
+
+	if doc.Version != apiVersion || doc.Name != "repo" || doc.Description != "A repo" || doc.Head.ID != head.ID || doc.Tree.ID != head.Tree {
+		t.Errorf("unexpected repo document: %+v", doc)
+	}
+
+	var detail APICommitDetail
+
+	path := apiPath("repo", "commit", head.ID+".json")
+
+	readJSON(t, path, &detail)
+
+	expected := []APIFileChange{{
+		Type:  "modified",
+		Path:  "a.txt",
+		OldID: testGit(t, gitDir, "rev-parse", "v1:a.txt"),
+		NewID: testGit(t, gitDir, "rev-parse", "main:a.txt"),
+		Added: 1,
+	}}
+
+	if detail.Commit.ID != head.ID || detail.Added != 1 || detail.Deleted != 0 || !reflect.DeepEqual(detail.Files, expected) {
+		t.Errorf("unexpected commit document: %+v", detail)
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !fi.ModTime().Equal(head.Time) {
+		t.Errorf("expecting commit document time %s, got %s", head.Time, fi.ModTime())
+	}
+
+	// a commit document without the time of its commit, such as one left by
+	// a failed write, is rebuilt
+	writeFiles(t, apiPath("repo", "commit"), map[string]string{head.ID + ".json": "{}", testID1 + ".json": "{}", "notes.txt": "kept"})
+
+	if err := buildAPI("repo", r, info, commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var rebuilt APICommitDetail
+
+	readJSON(t, path, &rebuilt)
+
+	if rebuilt.Commit.ID != head.ID {
+		t.Errorf("expecting commit document to be rebuilt, got %+v", rebuilt)
+	}
+
+	if fileExists(apiPath("repo", "commit", testID1+".json")) {
+		t.Error("expecting document of a commit not in the history to be removed")
+	}
+
+	if !fileExists(apiPath("repo", "commit", "notes.txt")) {
+		t.Error("expecting non-document file to be kept")
+	}
+}
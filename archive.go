@@ -0,0 +1,510 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type archiveFunc func(io.Writer, *Repo, *Commit, string) error
+
+var archivers = map[string]archiveFunc{
+	"tar.gz": writeTarGz,
+	"zip":    writeZip,
+}
+
+type Archive struct {
+	Ref, Format, Path string
+
+	commit *Commit
+	prefix string
+}
+
+// archiveList returns the archives, in each of the configured formats, of
+// HEAD and of every tag.
+func archiveList(repo string, head *Commit, tags []*Tag) []Archive {
+	var archives []Archive
+
+	for _, format := range config.ArchiveFormats {
+		if _, ok := archivers[format]; !ok {
+			continue
+		}
+
+		archives = append(archives, Archive{
+			Ref:    "HEAD",
+			Format: format,
+			Path:   "archive/HEAD." + format,
+			commit: head,
+			prefix: repo + "/",
+		})
+
+		for _, tag := range tags {
+			archives = append(archives, Archive{
+				Ref:    tag.Name,
+				Format: format,
+				Path:   "archive/" + tag.Name + "." + format,
+				commit: tag.Commit,
+				prefix: repo + "-" + tag.Name + "/",
+			})
+		}
+	}
+
+	return archives
+}
+
+func pendingArchives(repo string, archives []Archive) ([]Archive, error) {
+	var pending []Archive
+
+	for _, a := range archives {
+		if !force {
+			fi, err := os.Stat(filepath.Join(config.OutputDir, repo, filepath.FromSlash(a.Path)))
+			if err == nil && fi.ModTime().Equal(a.commit.Time) {
+				continue
+			} else if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("error stat'ing archive: %w", err)
+			}
+		}
+
+		pending = append(pending, a)
+	}
+
+	return pending, nil
+}
+
+func buildArchives(repo string, r *Repo, pending []Archive) error {
+	base := filepath.Join(config.OutputDir, repo)
+
+	for _, a := range pending {
+		outpath := filepath.Join(base, filepath.FromSlash(a.Path))
+
+		if err := os.MkdirAll(filepath.Dir(outpath), 0o755); err != nil {
+			return fmt.Errorf("error creating archive directory: %w", err)
+		}
+
+		f, err := os.Create(outpath)
+		if err != nil {
+			return fmt.Errorf("error creating archive: %w", err)
+		}
+
+		if err := archivers[a.Format](f, r, a.commit, a.prefix); err != nil {
+			f.Close()
+
+			return fmt.Errorf("error writing %s archive of %s: %w", a.Format, a.Ref, err)
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error closing archive: %w", err)
+		}
+
+		if err := os.Chtimes(outpath, a.commit.Time, a.commit.Time); err != nil {
+			return fmt.Errorf("error setting archive time: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// removeArchives removes any archives that are no longer wanted, such as
+// those of deleted tags.
+func removeArchives(repo string, archives []Archive) error {
+	base := filepath.Join(config.OutputDir, repo)
+	written := make(map[string]struct{}, len(archives))
+
+	for _, a := range archives {
+		written[filepath.Join(base, filepath.FromSlash(a.Path))] = struct{}{}
+	}
+
+	return filepath.WalkDir(filepath.Join(base, "archive"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		if _, ok := written[path]; !ok {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing archive: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// walkArchive calls fn with the path of each entry in the tree, depth first
+// in tree order, with directories preceding their contents. Submodules are
+// given as empty directories and entries marked export-ignore are skipped.
+func (r *Repo) walkArchive(attrs *attrStack, tree, base, prefix string, fn func(string, TreeEntry, Attributes) error) error {
+	entries, err := r.GetTreeEntries(tree)
+	if err != nil {
+		return err
+	}
+
+	l, err := attrs.push(r, entries, base)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		attrs.rules = attrs.rules[:l]
+	}()
+
+	for _, e := range entries {
+		p := base + e.Name
+		a := attrs.attributes(p, e.Mode == ModeDir || e.Mode == ModeGitLink)
+
+		if a.Set("export-ignore") {
+			continue
+		}
+
+		switch e.Mode {
+		case ModeDir:
+			if err := fn(prefix+p+"/", e, a); err != nil {
+				return err
+			}
+
+			if err := r.walkArchive(attrs, e.ID, p+"/", prefix, fn); err != nil {
+				return err
+			}
+		case ModeGitLink:
+			if err := fn(prefix+p+"/", e, a); err != nil {
+				return err
+			}
+		default:
+			if err := fn(prefix+p, e, a); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// archiveData returns the contents of a blob to be written to an archive,
+// expanding placeholders in regular files marked export-subst.
+func (r *Repo) archiveData(e TreeEntry, a Attributes, c *Commit) ([]byte, error) {
+	data, err := r.readBlob(e.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Mode != ModeSymlink && a.Set("export-subst") {
+		data = expandSubst(data, c)
+	}
+
+	return data, nil
+}
+
+// archiveMode returns the permissions for an entry as git archive would,
+// with the default umask of 002.
+func archiveMode(mode uint32) fs.FileMode {
+	switch mode {
+	case ModeDir, ModeGitLink:
+		return fs.ModeDir | 0o775
+	case ModeSymlink:
+		return fs.ModeSymlink | 0o777
+	}
+
+	if mode&0o111 != 0 {
+		return 0o775
+	}
+
+	return 0o664
+}
+
+func writeTarGz(w io.Writer, r *Repo, c *Commit, prefix string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": c.ID},
+	}); err != nil {
+		return fmt.Errorf("error writing global header: %w", err)
+	}
+
+	header := func(name string, mode fs.FileMode) *tar.Header {
+		return &tar.Header{
+			Name:    name,
+			Mode:    int64(mode.Perm()),
+			ModTime: c.Time,
+			Uname:   "root",
+			Gname:   "root",
+		}
+	}
+
+	dir := header(prefix, fs.ModeDir|0o775)
+	dir.Typeflag = tar.TypeDir
+
+	if err := tw.WriteHeader(dir); err != nil {
+		return fmt.Errorf("error writing directory header: %w", err)
+	}
+
+	attrs, err := r.newAttrStack()
+	if err != nil {
+		return err
+	}
+
+	if err := r.walkArchive(attrs, c.Tree, "", prefix, func(p string, e TreeEntry, a Attributes) error {
+		mode := archiveMode(e.Mode)
+		hdr := header(p, mode)
+
+		if mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+
+			return tw.WriteHeader(hdr)
+		}
+
+		data, err := r.archiveData(e, a, c)
+		if err != nil {
+			return err
+		}
+
+		if mode&fs.ModeSymlink != 0 {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(data)
+
+			return tw.WriteHeader(hdr)
+		}
+
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(data))
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		_, err = tw.Write(data)
+
+		return err
+	}); err != nil {
+		return fmt.Errorf("error writing tar entries: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error closing tar: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("error closing gzip: %w", err)
+	}
+
+	return nil
+}
+
+func writeZip(w io.Writer, r *Repo, c *Commit, prefix string) error {
+	zw := zip.NewWriter(w)
+
+	if err := zw.SetComment(c.ID); err != nil {
+		return fmt.Errorf("error setting zip comment: %w", err)
+	}
+
+	create := func(name string, mode fs.FileMode, data []byte) error {
+		fh := &zip.FileHeader{
+			Name:     name,
+			Modified: c.Time,
+			Method:   zip.Deflate,
+		}
+
+		// as with git archive, only symlinks and executables are given
+		// unix modes, with executables not having the umask applied
+		switch {
+		case mode.IsDir():
+			fh.Method = zip.Store
+			fh.ExternalAttrs = 0x10 // MS-DOS directory
+		case mode&fs.ModeSymlink != 0:
+			fh.SetMode(mode)
+		case mode&0o111 != 0:
+			fh.SetMode(0o755)
+		}
+
+		f, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(data)
+
+		return err
+	}
+
+	if err := create(prefix, fs.ModeDir|0o775, nil); err != nil {
+		return fmt.Errorf("error writing directory entry: %w", err)
+	}
+
+	attrs, err := r.newAttrStack()
+	if err != nil {
+		return err
+	}
+
+	if err := r.walkArchive(attrs, c.Tree, "", prefix, func(p string, e TreeEntry, a Attributes) error {
+		mode := archiveMode(e.Mode)
+
+		if mode.IsDir() {
+			return create(p, mode, nil)
+		}
+
+		data, err := r.archiveData(e, a, c)
+		if err != nil {
+			return err
+		}
+
+		return create(p, mode, data)
+	}); err != nil {
+		return fmt.Errorf("error writing zip entries: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error closing zip: %w", err)
+	}
+
+	return nil
+}
+
+// expandSubst replaces each $Format:...$ placeholder in the data with the
+// commit formatted as git log --pretty=format would.
+func expandSubst(data []byte, c *Commit) []byte {
+	const marker = "$Format:"
+
+	var buf []byte
+
+	for {
+		p := bytes.Index(data, []byte(marker))
+		if p < 0 {
+			break
+		}
+
+		end := bytes.IndexByte(data[p+len(marker):], '$')
+		if end < 0 {
+			break
+		}
+
+		buf = append(buf, data[:p]...)
+		buf = append(buf, formatCommit(string(data[p+len(marker):p+len(marker)+end]), c)...)
+		data = data[p+len(marker)+end+1:]
+	}
+
+	if buf == nil {
+		return data
+	}
+
+	return append(buf, data...)
+}
+
+func formatCommit(format string, c *Commit) string {
+	var sb strings.Builder
+
+	msg := c.Msg + "\n"
+	subject, body := msg, ""
+
+	if p := strings.Index(msg, "\n\n"); p >= 0 {
+		subject, body = msg[:p], strings.TrimLeft(msg[p:], "\n")
+	}
+
+	subject = strings.Join(strings.Fields(strings.ReplaceAll(strings.TrimSpace(subject), "\n", " ")), " ")
+
+	for len(format) > 0 {
+		p := strings.IndexByte(format, '%')
+		if p < 0 || p == len(format)-1 {
+			sb.WriteString(format)
+
+			break
+		}
+
+		sb.WriteString(format[:p])
+
+		format = format[p+1:]
+		l := 1
+
+		switch format[0] {
+		case 'H':
+			sb.WriteString(c.ID)
+		case 'h':
+			sb.WriteString(c.ID[:7])
+		case 'T':
+			sb.WriteString(c.Tree)
+		case 't':
+			sb.WriteString(c.Tree[:7])
+		case 'P':
+			sb.WriteString(strings.Join(c.Parents, " "))
+		case 'p':
+			for n, parent := range c.Parents {
+				if n > 0 {
+					sb.WriteByte(' ')
+				}
+
+				sb.WriteString(parent[:7])
+			}
+		case 'a', 'c':
+			name, email, t := c.Author, c.AuthorEmail, c.AuthorTime
+
+			if format[0] == 'c' {
+				name, email, t = c.Committer, c.CommitterEmail, c.Time
+			}
+
+			if len(format) < 2 {
+				sb.WriteByte('%')
+
+				l = 0
+
+				break
+			}
+
+			l = 2
+
+			switch format[1] {
+			case 'n':
+				sb.WriteString(name)
+			case 'e':
+				sb.WriteString(email)
+			case 'd':
+				sb.WriteString(t.Format("Mon Jan 2 15:04:05 2006 -0700"))
+			case 'D':
+				sb.WriteString(t.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+			case 'i':
+				sb.WriteString(t.Format("2006-01-02 15:04:05 -0700"))
+			case 'I':
+				sb.WriteString(t.Format("2006-01-02T15:04:05-07:00"))
+			case 't':
+				sb.WriteString(strconv.FormatInt(t.Unix(), 10))
+			case 's':
+				sb.WriteString(t.Format("2006-01-02"))
+			default:
+				sb.WriteByte('%')
+
+				l = 0
+			}
+		case 's':
+			sb.WriteString(subject)
+		case 'b':
+			sb.WriteString(body)
+		case 'B':
+			sb.WriteString(msg)
+		case 'n':
+			sb.WriteByte('\n')
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte('%')
+
+			l = 0
+		}
+
+		format = format[l:]
+	}
+
+	return sb.String()
+}
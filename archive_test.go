@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandSubst(t *testing.T) {
+	c := &Commit{
+		ID:             "0123456789abcdef0123456789abcdef01234567",
+		Tree:           "89abcdef0123456789abcdef0123456789abcdef",
+		Parents:        []string{"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"},
+		Author:         "Author",
+		AuthorEmail:    "author@example.com",
+		AuthorTime:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600)),
+		Committer:      "Committer",
+		CommitterEmail: "committer@example.com",
+		Time:           time.Unix(1600000000, 0).UTC(),
+		Msg:            "Subject\nline\n\nBody text.",
+	}
+
+	for n, test := range [...]struct {
+		Data, Expanded string
+	}{
+		{"no placeholders", "no placeholders"},
+		{"$Format:%H$", c.ID},
+		{"v$Format:%h$-$Format:%t$", "v0123456-89abcde"},
+		{"$Format:%P$|$Format:%p$", c.Parents[0] + " " + c.Parents[1] + "|1111111 2222222"},
+		{"$Format:%an <%ae>$", "Author <author@example.com>"},
+		{"$Format:%cn <%ce> %ct$", "Committer <committer@example.com> 1600000000"},
+		{"$Format:%ai$", "2020-01-02 03:04:05 +0100"},
+		{"$Format:%aI$", "2020-01-02T03:04:05+01:00"},
+		{"$Format:%as %ad$", "2020-01-02 Thu Jan 2 03:04:05 2020 +0100"},
+		{"$Format:%cD$", "Sun, 13 Sep 2020 12:26:40 +0000"},
+		{"$Format:%s$", "Subject line"},
+		{"$Format:%b$", "Body text.\n"},
+		{"$Format:%B$", c.Msg + "\n"},
+		{"$Format:100%% %x %a$", "100% %x %a"},
+		{"$Format:a%nb$", "a\nb"},
+		{"$Format:%H", "$Format:%H"},
+		{"$Format:%", "$Format:%"},
+	} {
+		if expanded := string(expandSubst([]byte(test.Data), c)); expanded != test.Expanded {
+			t.Errorf("test %d: expecting %q, got %q", n+1, test.Expanded, expanded)
+		}
+	}
+}
+
+// testArchiveRepo creates a repo with a regular file, an executable, a
+// symlink, nested directories and files marked export-ignore and
+// export-subst, returning the path of its git directory.
+func testArchiveRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+
+	testGit(t, dir, "init", "-q")
+	writeFiles(t, dir, map[string]string{
+		".gitattributes":  "ignored.txt export-ignore\nversion.txt export-subst\n",
+		"a.txt":           "a\n",
+		"run.sh":          "#!/bin/sh\n",
+		"dir/sub/c.txt":   "c\n",
+		"dir/ignored.txt": "ignored in a subdirectory too\n",
+		"ignored.txt":     "ignored\n",
+		"version.txt":     "$Format:%H %s$\n",
+	})
+
+	if err := os.Chmod(filepath.Join(dir, "run.sh"), 0o755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Skipf("unable to create symlink: %s", err)
+	}
+
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "update-index", "--chmod=+x", "run.sh")
+	testGit(t, dir, "commit", "-q", "-m", "archive me")
+
+	return filepath.Join(dir, ".git")
+}
+
+type archiveEntry struct {
+	Name, Link, Data string
+	Mode             fs.FileMode
+	ModTime          int64
+}
+
+func readTarEntries(t *testing.T, r io.Reader) (string, []archiveEntry) {
+	t.Helper()
+
+	var (
+		comment string
+		entries []archiveEntry
+		tr      = tar.NewReader(r)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return comment, entries
+		} else if err != nil {
+			t.Fatalf("unexpected error reading tar: %s", err)
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			comment = hdr.PAXRecords["comment"]
+
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading tar: %s", err)
+		}
+
+		entries = append(entries, archiveEntry{Name: hdr.Name, Link: hdr.Linkname, Data: string(data), Mode: hdr.FileInfo().Mode(), ModTime: hdr.ModTime.Unix()})
+	}
+}
+
+func readZipEntries(t *testing.T, data []byte) (string, []archiveEntry) {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error reading zip: %s", err)
+	}
+
+	entries := make([]archiveEntry, 0, len(zr.File))
+
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unexpected error reading zip: %s", err)
+		}
+
+		data, err := io.ReadAll(rc)
+
+		rc.Close()
+
+		if err != nil {
+			t.Fatalf("unexpected error reading zip: %s", err)
+		}
+
+		entries = append(entries, archiveEntry{Name: f.Name, Data: string(data), Mode: f.Mode(), ModTime: f.Modified.Unix()})
+	}
+
+	return zr.Comment, entries
+}
+
+func TestArchives(t *testing.T) {
+	gitDir := testArchiveRepo(t)
+	r := OpenRepo(gitDir)
+
+	c, err := r.GetCommit(testGit(t, gitDir, "rev-parse", "HEAD"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, format := range [...]string{"tar.gz", "zip"} {
+		var buf bytes.Buffer
+
+		if err := archivers[format](&buf, r, c, "repo/"); err != nil {
+			t.Errorf("%s: unexpected error: %s", format, err)
+
+			continue
+		}
+
+		cmd := exec.Command("git", "--git-dir", gitDir, "archive", "--format="+format, "--prefix=repo/", c.ID)
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull)
+
+		expected, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: git archive failed: %s", format, err)
+		}
+
+		var (
+			comment, expectedComment string
+			entries, expectedEntries []archiveEntry
+		)
+
+		if format == "zip" {
+			comment, entries = readZipEntries(t, buf.Bytes())
+			expectedComment, expectedEntries = readZipEntries(t, expected)
+		} else {
+			for _, data := range [...]*[]byte{&expected, nil} {
+				var src io.Reader = &buf
+
+				if data != nil {
+					src = bytes.NewReader(*data)
+				}
+
+				gz, err := gzip.NewReader(src)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %s", format, err)
+				}
+
+				if data != nil {
+					expectedComment, expectedEntries = readTarEntries(t, gz)
+				} else {
+					comment, entries = readTarEntries(t, gz)
+				}
+			}
+		}
+
+		if comment != expectedComment {
+			t.Errorf("%s: expecting comment %q, got %q", format, expectedComment, comment)
+		}
+
+		if !reflect.DeepEqual(entries, expectedEntries) {
+			t.Errorf("%s: expecting entries:\n%v\ngot:\n%v", format, expectedEntries, entries)
+		}
+	}
+}
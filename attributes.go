@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	attrTrue  = "\x00true"
+	attrFalse = "\x00false"
+)
+
+// Attributes are the git attributes that apply to a path.
+type Attributes map[string]string
+
+// Set returns true if the attribute is set, without a value.
+func (a Attributes) Set(name string) bool {
+	return a[name] == attrTrue
+}
+
+// Unset returns true if the attribute has been explicitly unset.
+func (a Attributes) Unset(name string) bool {
+	return a[name] == attrFalse
+}
+
+// Value returns the value of an attribute that was given one.
+func (a Attributes) Value(name string) (string, bool) {
+	v, ok := a[name]
+	if !ok || v == attrTrue || v == attrFalse {
+		return "", false
+	}
+
+	return v, true
+}
+
+type attrAssign struct {
+	name, value string
+}
+
+type attrRule struct {
+	base, pattern string
+	dir           bool
+	assigns       []attrAssign
+}
+
+func (a attrRule) match(p string, dir bool) bool {
+	if a.dir && !dir || !strings.HasPrefix(p, a.base) {
+		return false
+	}
+
+	p = p[len(a.base):]
+
+	if !strings.Contains(a.pattern, "/") {
+		p = p[strings.LastIndexByte(p, '/')+1:]
+	}
+
+	return wildmatch(strings.TrimPrefix(a.pattern, "/"), p)
+}
+
+// attrStack holds the attribute rules that apply while walking a tree, in
+// increasing order of precedence.
+type attrStack struct {
+	macros map[string][]attrAssign
+	rules  []attrRule
+	info   []attrRule
+}
+
+func (r *Repo) newAttrStack() (*attrStack, error) {
+	a := &attrStack{
+		macros: map[string][]attrAssign{
+			"binary": {{"diff", attrFalse}, {"merge", attrFalse}, {"text", attrFalse}},
+		},
+	}
+
+	if !r.bundle {
+		data, err := os.ReadFile(filepath.Join(r.path, "info", "attributes"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading info attributes: %w", err)
+		}
+
+		a.info = a.parse(data, "", true)
+	}
+
+	return a, nil
+}
+
+// push adds the rules from any .gitattributes file in the given tree, which
+// is at the given base path, returning the length of the rules to restore
+// when leaving the tree.
+func (a *attrStack) push(r *Repo, entries []TreeEntry, base string) (int, error) {
+	l := len(a.rules)
+
+	for _, e := range entries {
+		if e.Name == ".gitattributes" && e.Mode&0o170000 == 0o100000 {
+			data, err := r.readBlob(e.ID)
+			if err != nil {
+				return 0, fmt.Errorf("error reading attributes: %w", err)
+			}
+
+			a.rules = append(a.rules, a.parse(data, base, base == "")...)
+
+			break
+		}
+	}
+
+	return l, nil
+}
+
+func (a *attrStack) parse(data []byte, base string, macros bool) []attrRule {
+	var rules []attrRule
+
+	for _, line := range bytes.Split(data, newLine) {
+		line = bytes.TrimRight(line, "\r")
+		fields := strings.Fields(string(line))
+
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+
+		pattern := fields[0]
+
+		if pattern[0] == '"' {
+			// quoted patterns may contain spaces, so the fields need re-splitting
+			rest := strings.TrimLeft(string(line), " \t")
+
+			if p, err := strconv.QuotedPrefix(rest); err == nil {
+				if pattern, err = strconv.Unquote(p); err != nil {
+					continue
+				}
+
+				fields = append([]string{p}, strings.Fields(rest[len(p):])...)
+			}
+		}
+
+		assigns := make([]attrAssign, 0, len(fields)-1)
+
+		for _, f := range fields[1:] {
+			switch f[0] {
+			case '-':
+				assigns = append(assigns, attrAssign{f[1:], attrFalse})
+			case '!':
+				assigns = append(assigns, attrAssign{f[1:], ""})
+			default:
+				if p := strings.IndexByte(f, '='); p >= 0 {
+					assigns = append(assigns, attrAssign{f[:p], f[p+1:]})
+				} else {
+					assigns = append(assigns, attrAssign{f, attrTrue})
+				}
+			}
+		}
+
+		if strings.HasPrefix(pattern, "[attr]") {
+			if macros {
+				a.macros[pattern[6:]] = assigns
+			}
+
+			continue
+		} else if pattern[0] == '!' {
+			continue // negative patterns are not allowed
+		}
+
+		rule := attrRule{
+			base:    base,
+			pattern: pattern,
+			assigns: assigns,
+		}
+
+		if strings.HasSuffix(pattern, "/") {
+			rule.pattern = strings.TrimRight(pattern, "/")
+			rule.dir = true
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// attributes returns the attributes for the path, which is relative to the
+// root of the tree.
+func (a *attrStack) attributes(p string, dir bool) Attributes {
+	attrs := make(Attributes)
+
+	for _, rules := range [2][]attrRule{a.rules, a.info} {
+		for _, rule := range rules {
+			if rule.match(p, dir) {
+				a.assign(attrs, rule.assigns, 0)
+			}
+		}
+	}
+
+	return attrs
+}
+
+func (a *attrStack) assign(attrs Attributes, assigns []attrAssign, depth int) {
+	for _, as := range assigns {
+		if as.value == "" {
+			delete(attrs, as.name)
+		} else {
+			attrs[as.name] = as.value
+		}
+
+		if macro, ok := a.macros[as.name]; ok && as.value == attrTrue && depth < 10 {
+			a.assign(attrs, macro, depth+1)
+		}
+	}
+}
+
+// wildmatch matches a path against a glob pattern using the rules of git,
+// where a single star does not match a slash but a double star does.
+func wildmatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch c := pattern[0]; c {
+		case '*':
+			if strings.HasPrefix(pattern, "**") {
+				rest := strings.TrimLeft(pattern, "*")
+
+				if rest == "" {
+					return true
+				} else if rest[0] == '/' {
+					// "**/" matches zero or more directories
+					for {
+						if wildmatch(rest[1:], name) {
+							return true
+						}
+
+						p := strings.IndexByte(name, '/')
+						if p < 0 {
+							return false
+						}
+
+						name = name[p+1:]
+					}
+				}
+
+				pattern = rest
+			} else {
+				pattern = pattern[1:]
+			}
+
+			for n := 0; ; n++ {
+				if wildmatch(pattern, name[n:]) {
+					return true
+				} else if n == len(name) || name[n] == '/' {
+					return false
+				}
+			}
+		case '?':
+			if len(name) == 0 || name[0] == '/' {
+				return false
+			}
+
+			pattern = pattern[1:]
+			name = name[1:]
+		case '[':
+			if len(name) == 0 || name[0] == '/' {
+				return false
+			}
+
+			l, ok := matchClass(pattern, name[0])
+			if !ok {
+				return false
+			}
+
+			pattern = pattern[l:]
+			name = name[1:]
+		default:
+			if c == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+				c = pattern[0]
+			}
+
+			if len(name) == 0 || name[0] != c {
+				return false
+			}
+
+			pattern = pattern[1:]
+			name = name[1:]
+		}
+	}
+
+	return len(name) == 0
+}
+
+// matchClass matches a character against the bracket expression at the
+// start of the pattern, returning the length of the expression.
+func matchClass(pattern string, c byte) (int, bool) {
+	n := 1
+	negate := false
+
+	if n < len(pattern) && (pattern[n] == '!' || pattern[n] == '^') {
+		negate = true
+		n++
+	}
+
+	matched := false
+
+	for first := true; n < len(pattern); first = false {
+		ch := pattern[n]
+
+		if ch == ']' && !first {
+			return n + 1, matched != negate
+		} else if ch == '[' && n+1 < len(pattern) && pattern[n+1] == ':' {
+			if end := strings.Index(pattern[n+2:], ":]"); end >= 0 {
+				if matchCharClass(pattern[n+2:n+2+end], c) {
+					matched = true
+				}
+
+				n += end + 4
+
+				continue
+			}
+		} else if ch == '\\' && n+1 < len(pattern) {
+			n++
+			ch = pattern[n]
+		}
+
+		if n+2 < len(pattern) && pattern[n+1] == '-' && pattern[n+2] != ']' {
+			hi := pattern[n+2]
+
+			if hi == '\\' && n+3 < len(pattern) {
+				hi = pattern[n+3]
+				n++
+			}
+
+			if ch <= c && c <= hi {
+				matched = true
+			}
+
+			n += 3
+
+			continue
+		}
+
+		if ch == c {
+			matched = true
+		}
+
+		n++
+	}
+
+	return 0, false
+}
+
+func matchCharClass(class string, c byte) bool {
+	switch class {
+	case "alnum":
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+	case "alpha":
+		return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "digit":
+		return '0' <= c && c <= '9'
+	case "lower":
+		return 'a' <= c && c <= 'z'
+	case "space":
+		return c == ' ' || '\t' <= c && c <= '\r'
+	case "upper":
+		return 'A' <= c && c <= 'Z'
+	case "xdigit":
+		return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+	case "punct":
+		return '!' <= c && c <= '/' || ':' <= c && c <= '@' || '[' <= c && c <= '`' || '{' <= c && c <= '~'
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWildmatch(t *testing.T) {
+	for n, test := range [...]struct {
+		Pattern, Name string
+		Match         bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"*.go", "main.go", true},
+		{"*.go", "dir/main.go", false},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", false},
+		{"**/x", "x", true},
+		{"**/x", "a/b/x", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"[abc].txt", "b.txt", true},
+		{"[!abc].txt", "b.txt", false},
+		{"[a-c].txt", "c.txt", true},
+		{"[[:digit:]]*", "1st", true},
+		{"[[:digit:]]*", "first", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+	} {
+		if match := wildmatch(test.Pattern, test.Name); match != test.Match {
+			t.Errorf("test %d: expecting %q matching %q to be %t", n+1, test.Pattern, test.Name, test.Match)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	a := &attrStack{
+		macros: map[string][]attrAssign{
+			"binary": {{"diff", attrFalse}, {"merge", attrFalse}, {"text", attrFalse}},
+		},
+	}
+
+	a.rules = append(a.rules, a.parse([]byte("# comment\n"+
+		"[attr]generated export-ignore -diff\n"+
+		"*.go text eol=lf\r\n"+
+		"*.png binary\n"+
+		"docs/ export-ignore\n"+
+		"/VERSION export-subst\n"+
+		"\"with space.txt\" quoted\n"+
+		"!negated text\n"), "", true)...)
+	a.rules = append(a.rules, a.parse([]byte("*.go -text\n"+
+		"gen.go generated\n"+
+		"[attr]ignored text\n"+
+		"*.txt !quoted\n"), "sub/", false)...)
+
+	for n, test := range [...]struct {
+		Path  string
+		Dir   bool
+		Attrs Attributes
+	}{
+		{ // 1
+			Path:  "main.go",
+			Attrs: Attributes{"text": attrTrue, "eol": "lf"},
+		},
+		{ // 2
+			Path:  "sub/main.go",
+			Attrs: Attributes{"text": attrFalse, "eol": "lf"},
+		},
+		{ // 3
+			Path:  "sub/gen.go",
+			Attrs: Attributes{"text": attrFalse, "eol": "lf", "generated": attrTrue, "export-ignore": attrTrue, "diff": attrFalse},
+		},
+		{ // 4
+			Path:  "img/logo.png",
+			Attrs: Attributes{"binary": attrTrue, "diff": attrFalse, "merge": attrFalse, "text": attrFalse},
+		},
+		{ // 5
+			Path:  "docs",
+			Dir:   true,
+			Attrs: Attributes{"export-ignore": attrTrue},
+		},
+		{ // 6
+			Path:  "docs",
+			Attrs: Attributes{},
+		},
+		{ // 7
+			Path:  "VERSION",
+			Attrs: Attributes{"export-subst": attrTrue},
+		},
+		{ // 8
+			Path:  "sub/VERSION",
+			Attrs: Attributes{},
+		},
+		{ // 9
+			Path:  "with space.txt",
+			Attrs: Attributes{"quoted": attrTrue},
+		},
+		{ // 10
+			Path:  "sub/with space.txt",
+			Attrs: Attributes{},
+		},
+		{ // 11
+			Path:  "negated",
+			Attrs: Attributes{},
+		},
+	} {
+		if attrs := a.attributes(test.Path, test.Dir); !reflect.DeepEqual(attrs, test.Attrs) {
+			t.Errorf("test %d: expecting attributes %v, got %v", n+1, test.Attrs, attrs)
+		}
+	}
+
+	if _, ok := a.macros["ignored"]; ok {
+		t.Error("expecting macros outside of the root to be ignored")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+)
+
+type BlameLine struct {
+	*Commit
+	Path string
+	Line int
+}
+
+func (r *Repo) lookupPath(tree, p string) (string, error) {
+	parts := strings.Split(p, "/")
+
+	for _, dir := range parts[:len(parts)-1] {
+		t, err := r.GetTree(tree)
+		if err != nil {
+			return "", err
+		}
+
+		if tree = t[dir+"/"]; tree == "" {
+			return "", nil
+		}
+	}
+
+	t, err := r.GetTree(tree)
+	if err != nil {
+		return "", err
+	}
+
+	name := parts[len(parts)-1]
+
+	if id, ok := t[name]; ok {
+		return id, nil
+	}
+
+	return t["/"+name], nil
+}
+
+func (r *Repo) blameLines(e HistoryEntry) ([]string, error) {
+	id, err := r.lookupPath(e.Tree, e.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := r.readBlob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinary(data) {
+		return nil, nil
+	}
+
+	return splitLines(data), nil
+}
+
+// blame attributes each line of the newest version of a file to the commit
+// that introduced it, using the history of commits that changed the file.
+func (r *Repo) blame(history []HistoryEntry) ([]BlameLine, error) {
+	if len(history) == 0 {
+		return nil, nil
+	}
+
+	lines, err := r.blameLines(history[0])
+	if err != nil || lines == nil {
+		return nil, err
+	}
+
+	blame := make([]BlameLine, len(lines))
+	pos := make(map[int]int, len(lines))
+
+	for n := range lines {
+		pos[n] = n
+	}
+
+	for n, e := range history {
+		if n == len(history)-1 {
+			for line, p := range pos {
+				blame[line] = BlameLine{Commit: e.Commit, Path: e.Path, Line: p + 1}
+			}
+
+			break
+		}
+
+		parent, err := r.blameLines(history[n+1])
+		if err != nil {
+			return nil, err
+		}
+
+		previous := make(map[int]int, len(lines))
+
+		for _, edit := range editScript(parent, lines) {
+			if edit.typ == LineContext {
+				previous[edit.new] = edit.old
+			}
+		}
+
+		for line, p := range pos {
+			if old, ok := previous[p]; ok {
+				pos[line] = old
+			} else {
+				blame[line] = BlameLine{Commit: e.Commit, Path: e.Path, Line: p + 1}
+
+				delete(pos, line)
+			}
+		}
+
+		if len(pos) == 0 {
+			break
+		}
+
+		lines = parent
+	}
+
+	return blame, nil
+}
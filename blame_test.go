@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.RenameThreshold = 50
+	r := OpenRepo(gitDir)
+
+	histories, err := r.fileHistories(ids["c7"], true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Path  string
+		Blame []string
+	}{
+		{ // 1
+			Path:  "a.txt",
+			Blame: []string{"c1:a.txt:1", "c2:a.txt:2", "c1:a.txt:3", "c4:a.txt:4"},
+		},
+		{ // 2
+			Path:  "dir/moved.txt",
+			Blame: []string{"c1:b.txt:1", "c7:dir/moved.txt:2"},
+		},
+		{ // 3
+			Path:  "dir/c.txt",
+			Blame: []string{"c6:dir/c.txt:1"},
+		},
+		{ // 4
+			Path: "missing.txt",
+		},
+	} {
+		lines, err := r.blame(histories[test.Path])
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var blame []string
+
+		for _, l := range lines {
+			blame = append(blame, l.Msg+":"+l.Path+":"+strconv.Itoa(l.Line))
+		}
+
+		if !reflect.DeepEqual(blame, test.Blame) {
+			t.Errorf("test %d: expecting blame %v, got %v", n+1, test.Blame, blame)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"vimagination.zapto.org/byteio"
+	"vimagination.zapto.org/memio"
+)
+
+const bundleSignature = "# v2 git bundle\n"
+
+type reachEntry struct {
+	id, name string
+}
+
+// reachableObjects returns all of the objects reachable from the wants that
+// are not reachable from the haves, naming trees and blobs by their paths.
+// Replacement refs and grafts are ignored as the objects are to be
+// transferred.
+func (r *Repo) reachableObjects(wants, haves []string) ([]PackObject, error) {
+	seen := make(map[string]struct{})
+
+	if _, err := r.walkObjects(haves, seen, nil); err != nil {
+		return nil, err
+	}
+
+	return r.walkObjects(wants, seen, []PackObject{})
+}
+
+func (r *Repo) walkObjects(ids []string, seen map[string]struct{}, objects []PackObject) ([]PackObject, error) {
+	stack := make([]reachEntry, 0, len(ids))
+
+	for n := len(ids) - 1; n >= 0; n-- {
+		stack = append(stack, reachEntry{id: ids[n]})
+	}
+
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if _, ok := seen[e.id]; ok {
+			continue
+		}
+
+		seen[e.id] = struct{}{}
+
+		typ, data, err := r.readRaw(e.id)
+		if err != nil {
+			return nil, fmt.Errorf("error reading object %s: %w", e.id, err)
+		}
+
+		if objects != nil {
+			objects = append(objects, PackObject{ID: e.id, Name: e.name})
+		}
+
+		switch typ {
+		case ObjectCommit:
+			var parents []string
+
+			for _, line := range bytes.Split(data, newLine) {
+				if len(line) == 0 {
+					break
+				} else if bytes.HasPrefix(line, []byte("tree ")) {
+					stack = append(stack, reachEntry{id: string(line[5:])})
+				} else if bytes.HasPrefix(line, []byte("parent ")) {
+					parents = append(parents, string(line[7:]))
+				}
+			}
+
+			for n := len(parents) - 1; n >= 0; n-- {
+				stack = append(stack, reachEntry{id: parents[n]})
+			}
+		case ObjectTag:
+			if p := bytes.IndexByte(data, '\n'); p > 7 && bytes.HasPrefix(data, []byte("object ")) {
+				stack = append(stack, reachEntry{id: string(data[7:p])})
+			}
+		case ObjectTree:
+			entries, err := parseTreeEntries(data)
+			if err != nil {
+				return nil, fmt.Errorf("error reading tree %s: %w", e.id, err)
+			}
+
+			for n := len(entries) - 1; n >= 0; n-- {
+				te := entries[n]
+				if te.Mode == ModeGitLink {
+					continue
+				}
+
+				name := te.Name
+				if e.name != "" {
+					name = e.name + "/" + name
+				}
+
+				stack = append(stack, reachEntry{id: te.ID, name: name})
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// bundleHeader returns the header of a bundle containing HEAD and every ref in
+// the repository.
+func (r *Repo) bundleHeader() ([]byte, []string, error) {
+	refs, err := r.listRefs("refs/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading refs: %w", err)
+	}
+
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var (
+		buf  bytes.Buffer
+		tips []string
+	)
+
+	buf.WriteString(bundleSignature)
+
+	if head, err := r.readHeadRef(); err == nil {
+		if id, ok := refs[head]; ok {
+			fmt.Fprintf(&buf, "%s HEAD\n", id)
+		}
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", refs[name], name)
+
+		tips = append(tips, refs[name])
+	}
+
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), tips, nil
+}
+
+func bundlePath(repo string) string {
+	return filepath.Join(config.OutputDir, repo, repo+".bundle")
+}
+
+// readBundleHeader reads the header of an existing bundle, returning nil if
+// there isn't one.
+func readBundleHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening bundle: %w", err)
+	}
+
+	defer f.Close()
+
+	var (
+		buf bytes.Buffer
+		br  = bufio.NewReader(f)
+	)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, nil
+		}
+
+		buf.Write(line)
+
+		if len(line) == 1 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// buildBundle writes a bundle of the whole repository, returning true if the
+// bundle was (re)written. A bundle is only written when the refs have changed.
+func buildBundle(repo string, r *Repo) (bool, error) {
+	header, tips, err := r.bundleHeader()
+	if err != nil {
+		return false, err
+	}
+
+	path := bundlePath(repo)
+
+	if !force {
+		existing, err := readBundleHeader(path)
+		if err != nil {
+			return false, err
+		} else if bytes.Equal(existing, header) {
+			return false, nil
+		}
+	}
+
+	objects, err := r.reachableObjects(tips, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, fmt.Errorf("error creating bundle directory: %w", err)
+	}
+
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return false, fmt.Errorf("error creating bundle: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+
+	if _, err := w.Write(header); err != nil {
+		f.Close()
+
+		return false, fmt.Errorf("error writing bundle header: %w", err)
+	}
+
+	if _, err := r.WritePack(w, objects); err != nil {
+		f.Close()
+
+		return false, fmt.Errorf("error writing bundle pack: %w", err)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+
+		return false, fmt.Errorf("error writing bundle: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("error closing bundle: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return false, fmt.Errorf("error moving bundle: %w", err)
+	}
+
+	return true, nil
+}
+
+const bundlePack = "bundle"
+
+// loadBundleRefsData reads the refs from the header of a bundle file, leaving
+// the pack to be indexed when the first object is read.
+func (r *Repo) loadBundleRefsData() {
+	f, err := os.Open(r.path)
+	if err != nil {
+		r.bundleErr = fmt.Errorf("error opening bundle: %w", err)
+
+		return
+	}
+
+	defer f.Close()
+
+	var (
+		header []byte
+		br     = bufio.NewReader(f)
+	)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			r.bundleErr = fmt.Errorf("error reading bundle header: %w", err)
+
+			return
+		}
+
+		header = append(header, line...)
+
+		if len(line) == 1 {
+			break
+		}
+	}
+
+	r.bundleRefs, _, r.bundleErr = parseBundle(header)
+}
+
+func (r *Repo) readBundleRefs() (map[string]string, error) {
+	r.loadBundleRefs.Do(r.loadBundleRefsData)
+
+	return r.bundleRefs, r.bundleErr
+}
+
+// loadBundleData reads the pack from a bundle file, indexing its objects.
+func (r *Repo) loadBundleData() {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		r.packsErr = fmt.Errorf("error reading bundle: %w", err)
+
+		return
+	}
+
+	_, packData, err := parseBundle(data)
+	if err != nil {
+		r.packsErr = err
+
+		return
+	}
+
+	if len(packData) < 32 || string(packData[:4]) != "PACK" {
+		r.packsErr = errors.New("invalid pack header")
+
+		return
+	}
+
+	if packData[4] != 0 || packData[5] != 0 || packData[6] != 0 || packData[7] != 2 {
+		r.packsErr = fmt.Errorf("read unsupported pack version: %x", packData[4:8])
+
+		return
+	}
+
+	r.packs = map[string]*pack{
+		bundlePack: {
+			data:    packData,
+			objects: make(map[uint64]object),
+		},
+	}
+	r.packObjects = make(map[string]packObject)
+
+	if err := r.indexBundle(); err != nil {
+		r.packsErr = fmt.Errorf("error indexing bundle: %w", err)
+	}
+}
+
+// readBundleObject reads the base object of a ref delta in a bundle. The base
+// can only be in the bundle pack, which may still be being indexed, so it is
+// looked up directly instead of through readObject.
+func (r *Repo) readBundleObject(id string, want int) (io.ReadCloser, error) {
+	p, ok := r.packObjects[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown object: %s", id)
+	}
+
+	return r.readPackOffset(p.pack, p.offset, want)
+}
+
+func (r *Repo) readBundleObjectType(id string) (int, error) {
+	p, ok := r.packObjects[id]
+	if !ok {
+		return 0, fmt.Errorf("unknown object: %s", id)
+	}
+
+	return r.readPackType(p.pack, p.offset)
+}
+
+// parseBundle splits a version 2 or 3 bundle into its refs and pack data.
+func parseBundle(data []byte) (map[string]string, []byte, error) {
+	p := bytes.IndexByte(data, '\n')
+	if p < 0 {
+		return nil, nil, errors.New("invalid bundle header")
+	}
+
+	signature := string(data[:p+1])
+
+	if signature != bundleSignature && signature != "# v3 git bundle\n" {
+		return nil, nil, errors.New("invalid bundle signature")
+	}
+
+	refs := make(map[string]string)
+
+	for data = data[p+1:]; ; {
+		p = bytes.IndexByte(data, '\n')
+		if p < 0 {
+			return nil, nil, errors.New("invalid bundle header")
+		}
+
+		line := data[:p]
+		data = data[p+1:]
+
+		if len(line) == 0 {
+			return refs, data, nil
+		}
+
+		switch line[0] {
+		case '@':
+			if signature == bundleSignature {
+				return nil, nil, errors.New("invalid bundle header")
+			} else if bytes.HasPrefix(line, []byte("@object-format=")) && string(line[15:]) != "sha1" {
+				return nil, nil, fmt.Errorf("unsupported object format: %s", line[15:])
+			}
+		case '-':
+			return nil, nil, errors.New("bundles with prerequisites are not supported")
+		default:
+			if len(line) < 42 || line[40] != ' ' || checkSHA(line[:40]) == "" {
+				return nil, nil, fmt.Errorf("invalid bundle ref: %s", line)
+			}
+
+			refs[string(line[41:])] = string(line[:40])
+		}
+	}
+}
+
+// indexBundle finds the IDs of all of the objects in the bundle pack, which
+// requires decompressing and, for deltas, patching every object.
+func (r *Repo) indexBundle() error {
+	data := r.packs[bundlePack].data
+	count := binary.BigEndian.Uint32(data[8:12])
+	offsets := make([]uint64, 0, count)
+	pack := memio.Open(data[:len(data)-20])
+
+	if _, err := pack.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+
+	var z io.ReadCloser
+
+	for n := uint32(0); n < count; n++ {
+		o, err := pack.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		offsets = append(offsets, uint64(o))
+
+		buf, err := pack.ReadByte()
+		if err != nil {
+			return fmt.Errorf("error reading pack object type: %w", err)
+		}
+
+		typ := int(buf>>4) & 7
+
+		for buf&0x80 != 0 {
+			if buf, err = pack.ReadByte(); err != nil {
+				return fmt.Errorf("error reading pack object size: %w", err)
+			}
+		}
+
+		switch typ {
+		case ObjectOffsetDelta:
+			ber := byteio.BigEndianReader{Reader: pack}
+
+			if _, _, err := ber.ReadUintX(); err != nil {
+				return fmt.Errorf("error reading offset: %w", err)
+			}
+		case ObjectRefDelta:
+			if _, err := pack.Seek(20, io.SeekCurrent); err != nil {
+				return fmt.Errorf("error reading delta ref: %w", err)
+			}
+		}
+
+		if z == nil {
+			z, err = zlib.NewReader(pack)
+		} else {
+			err = z.(zlib.Resetter).Reset(pack, nil)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error starting to decompress object: %w", err)
+		}
+
+		if _, err := io.Copy(io.Discard, z); err != nil {
+			return fmt.Errorf("error decompressing object: %w", err)
+		}
+	}
+
+	// objects stored as ref deltas can only be read once their base has been
+	// indexed, so any failures are retried until no progress is made
+	for len(offsets) > 0 {
+		var (
+			failed  []uint64
+			lastErr error
+		)
+
+		for _, o := range offsets {
+			id, err := r.hashPackObject(bundlePack, o)
+			if err != nil {
+				failed = append(failed, o)
+				lastErr = err
+
+				continue
+			}
+
+			r.packObjects[id] = packObject{
+				pack:   bundlePack,
+				offset: o,
+			}
+		}
+
+		if len(failed) == len(offsets) {
+			return lastErr
+		}
+
+		offsets = failed
+	}
+
+	return nil
+}
+
+func (r *Repo) hashPackObject(p string, o uint64) (string, error) {
+	typ, err := r.readPackType(p, o)
+	if err != nil {
+		return "", err
+	}
+
+	rc, err := r.readPackOffset(p, o, typ)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(rc)
+
+	rc.Close()
+
+	if err != nil {
+		return "", fmt.Errorf("error reading object: %w", err)
+	}
+
+	h := sha1.New()
+
+	fmt.Fprintf(h, "%s%d\x00", objectHeaders[typ], len(data))
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bundleHead guesses the branch that HEAD refers to, as a bundle only records
+// the ID of HEAD.
+func (r *Repo) bundleHead() (string, error) {
+	refs, err := r.readBundleRefs()
+	if err != nil {
+		return "", err
+	}
+
+	id, hasHead := refs["HEAD"]
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/heads/") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !hasHead || refs[name] == id {
+			return name, nil
+		}
+	}
+
+	if hasHead {
+		return "HEAD", nil
+	}
+
+	return "", errors.New("no HEAD in bundle")
+}
+
+func (r *Repo) readBundleRef(name string) (string, error) {
+	refs, err := r.readBundleRefs()
+	if err != nil {
+		return "", err
+	}
+
+	id, ok := refs[name]
+	if !ok {
+		return "", fmt.Errorf("unknown ref: %s", name)
+	}
+
+	return id, nil
+}
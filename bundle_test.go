@@ -0,0 +1,364 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	return testGitEnv(t, dir, nil, args...)
+}
+
+// testGitEnv runs git with a fixed identity and time, with any of the given
+// environment variables taking precedence.
+func testGitEnv(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_AUTHOR_NAME=Author",
+		"GIT_AUTHOR_EMAIL=author@example.com",
+		"GIT_AUTHOR_DATE=2020-01-02T03:04:05Z",
+		"GIT_COMMITTER_NAME=Committer",
+		"GIT_COMMITTER_EMAIL=committer@example.com",
+		"GIT_COMMITTER_DATE=2020-01-02T03:04:05Z",
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// testGitRepo creates a repo with a few commits on two branches, with both a
+// lightweight and an annotated tag, returning the path of its git directory.
+func testGitRepo(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+
+	var text strings.Builder
+
+	for n := 0; n < 100; n++ {
+		text.WriteString("a line of text that is repeated with a number ")
+		text.WriteString(strings.Repeat("x", n%7))
+		text.WriteString("\n")
+	}
+
+	testGit(t, dir, "init", "-q")
+	testGit(t, dir, "symbolic-ref", "HEAD", "refs/heads/main")
+	writeFiles(t, dir, map[string]string{"a.txt": text.String(), "dir/b.txt": "b\n"})
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "commit", "-q", "-m", "first")
+	testGit(t, dir, "tag", "v1")
+	writeFiles(t, dir, map[string]string{"a.txt": text.String() + "another line\n"})
+	testGit(t, dir, "commit", "-q", "-a", "-m", "second")
+	testGit(t, dir, "tag", "-a", "-m", "version 2", "v2")
+	testGit(t, dir, "checkout", "-q", "-b", "other", "v1")
+	writeFiles(t, dir, map[string]string{"dir/c.txt": "c\n"})
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "commit", "-q", "-m", "third")
+	testGit(t, dir, "checkout", "-q", "main")
+
+	return filepath.Join(dir, ".git")
+}
+
+func TestBuildBundle(t *testing.T) {
+	gitDir := testGitRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+
+	r := OpenRepo(gitDir)
+
+	written, err := buildBundle("repo", r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !written {
+		t.Fatal("expecting bundle to be written")
+	}
+
+	path := bundlePath("repo")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if written, err = buildBundle("repo", OpenRepo(gitDir)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if written {
+		t.Error("expecting unchanged bundle not to be rewritten")
+	}
+
+	testGit(t, gitDir, "bundle", "verify", path)
+
+	expected := testGit(t, gitDir, "show-ref", "--head")
+
+	if heads := testGit(t, gitDir, "bundle", "list-heads", path); heads != expected {
+		t.Errorf("expecting bundle heads:\n%s\ngot:\n%s", expected, heads)
+	}
+
+	clone := filepath.Join(t.TempDir(), "clone")
+
+	testGit(t, gitDir, "clone", "-q", "--mirror", path, clone)
+	testGit(t, clone, "fsck", "--strict")
+
+	objects := sortedStrings(strings.Split(testGit(t, clone, "rev-list", "--objects", "--all"), "\n"))
+
+	if expected := sortedStrings(strings.Split(testGit(t, gitDir, "rev-list", "--objects", "--all"), "\n")); !reflect.DeepEqual(objects, expected) {
+		t.Errorf("expecting clone objects %v, got %v", expected, objects)
+	}
+
+	testGit(t, filepath.Dir(gitDir), "commit", "-q", "--allow-empty", "-m", "fourth")
+
+	if written, err = buildBundle("repo", OpenRepo(gitDir)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !written {
+		t.Error("expecting bundle to be rewritten when the refs change")
+	}
+
+	if nfi, err := os.Stat(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if os.SameFile(fi, nfi) {
+		t.Error("expecting the bundle to be replaced")
+	}
+}
+
+func TestReachableObjects(t *testing.T) {
+	gitDir := testGitRepo(t)
+	r := OpenRepo(gitDir)
+	main := testGit(t, gitDir, "rev-parse", "main")
+	v1 := testGit(t, gitDir, "rev-parse", "v1")
+
+	objects, err := r.reachableObjects([]string{main}, []string{v1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var ids []string
+
+	for _, o := range objects {
+		ids = append(ids, o.ID)
+	}
+
+	expected := strings.Fields(testGit(t, gitDir, "rev-list", "--objects", "--no-object-names", main, "^"+v1))
+
+	if !reflect.DeepEqual(sortedStrings(ids), sortedStrings(expected)) {
+		t.Errorf("expecting objects %v, got %v", expected, ids)
+	}
+
+	for _, o := range objects {
+		if o.ID == testGit(t, gitDir, "rev-parse", "main:a.txt") && o.Name != "a.txt" {
+			t.Errorf("expecting blob to be named a.txt, got %q", o.Name)
+		}
+	}
+}
+
+func sortedStrings(s []string) []string {
+	s = append([]string{}, s...)
+
+	sort.Strings(s)
+
+	return s
+}
+
+func TestParseBundle(t *testing.T) {
+	for n, test := range [...]struct {
+		Data string
+		Refs map[string]string
+		Pack string
+		Err  bool
+	}{
+		{ // 1
+			Data: "# v2 git bundle\n" + testID1 + " HEAD\n" + testID1 + " refs/heads/main\n\nPACK",
+			Refs: map[string]string{"HEAD": testID1, "refs/heads/main": testID1},
+			Pack: "PACK",
+		},
+		{ // 2
+			Data: "# v3 git bundle\n@object-format=sha1\n@filter=blob:none\n" + testID2 + " refs/tags/v1\n\n",
+			Refs: map[string]string{"refs/tags/v1": testID2},
+		},
+		{ // 3
+			Data: "# v3 git bundle\n@object-format=sha256\n\n",
+			Err:  true,
+		},
+		{ // 4
+			Data: "# v2 git bundle\n@object-format=sha1\n\n",
+			Err:  true,
+		},
+		{ // 5
+			Data: "# v2 git bundle\n-" + testID1 + " parent\n" + testID2 + " refs/heads/main\n\n",
+			Err:  true,
+		},
+		{ // 6
+			Data: "# v2 git bundle\n" + testID1[:39] + " refs/heads/main\n\n",
+			Err:  true,
+		},
+		{ // 7
+			Data: "# v2 git bundle\n" + testID1 + " refs/heads/main\n",
+			Err:  true,
+		},
+		{ // 8
+			Data: "# v4 git bundle\n\n",
+			Err:  true,
+		},
+	} {
+		refs, pack, err := parseBundle([]byte(test.Data))
+		if test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(refs, test.Refs) {
+			t.Errorf("test %d: expecting refs %v, got %v", n+1, test.Refs, refs)
+		} else if string(pack) != test.Pack {
+			t.Errorf("test %d: expecting pack %q, got %q", n+1, test.Pack, pack)
+		}
+	}
+}
+
+func TestBundleLazy(t *testing.T) {
+	gitDir := testGitRepo(t)
+	path := filepath.Join(t.TempDir(), "repo.bundle")
+
+	testGit(t, gitDir, "bundle", "create", "-q", path, "--all")
+
+	r := OpenRepo(path)
+
+	id, err := r.GetLatestCommitID()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if expected := testGit(t, gitDir, "rev-parse", "main"); id != expected {
+		t.Errorf("expecting latest commit %s, got %s", expected, id)
+	}
+
+	if refs, err := r.listRefs("refs/tags/"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if len(refs) != 2 {
+		t.Errorf("expecting 2 tags, got %v", refs)
+	}
+
+	if r.packs != nil {
+		t.Error("expecting bundle pack not to be read before an object is")
+	}
+
+	if c, err := r.GetCommit(id); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if c.Msg != "second" {
+		t.Errorf("expecting commit message %q, got %q", "second", c.Msg)
+	}
+
+	if r.packs == nil {
+		t.Error("expecting bundle pack to be read")
+	}
+}
+
+func TestOpenRepoBundle(t *testing.T) {
+	gitDir := testGitRepo(t)
+	main := testGit(t, gitDir, "rev-parse", "main")
+	dir := t.TempDir()
+
+	testGit(t, gitDir, "bundle", "create", "-q", filepath.Join(dir, "file.bundle"), "--all")
+	testGit(t, gitDir, "bundle", "create", "-q", filepath.Join(dir, "file"), "--all")
+	testGit(t, dir, "clone", "-q", "--bare", gitDir, filepath.Join(dir, "bare.bundle"))
+
+	for n, test := range [...]struct {
+		Path   string
+		Bundle bool
+	}{
+		{ // 1
+			Path:   "file.bundle",
+			Bundle: true,
+		},
+		{ // 2
+			Path:   "file",
+			Bundle: true,
+		},
+		{ // 3
+			Path: "bare.bundle",
+		},
+	} {
+		r := OpenRepo(filepath.Join(dir, test.Path))
+
+		if r.bundle != test.Bundle {
+			t.Errorf("test %d: expecting bundle to be %v, got %v", n+1, test.Bundle, r.bundle)
+		}
+
+		if id, err := r.GetLatestCommitID(); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if id != main {
+			t.Errorf("test %d: expecting latest commit %s, got %s", n+1, main, id)
+		}
+	}
+}
+
+func TestBundleRefDelta(t *testing.T) {
+	gitDir := testGitRepo(t)
+	main := testGit(t, gitDir, "rev-parse", "main")
+
+	cmd := exec.Command("git", "-C", gitDir, "pack-objects", "-q", "--revs", "--stdout")
+	cmd.Stdin = strings.NewReader("refs/heads/main\n")
+
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git pack-objects failed: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "repo.bundle")
+
+	writeFiles(t, filepath.Dir(path), map[string]string{
+		"repo.bundle": bundleSignature + main + " refs/heads/main\n\n" + string(pack),
+	})
+
+	r := OpenRepo(path)
+	expected := strings.Fields(testGit(t, gitDir, "rev-list", "--objects", "--no-object-names", main))
+
+	for _, id := range expected {
+		typ, data, err := r.readRaw(id)
+		if err != nil {
+			t.Errorf("unexpected error reading %s: %s", id, err)
+
+			continue
+		}
+
+		if etyp := testGit(t, gitDir, "cat-file", "-t", id); objectHeaders[typ] != etyp+" " {
+			t.Errorf("expecting object %s to be a %s, got type %d", id, etyp, typ)
+		}
+
+		if size := testGit(t, gitDir, "cat-file", "-s", id); size != strconv.Itoa(len(data)) {
+			t.Errorf("expecting object %s to have size %s, got %d", id, size, len(data))
+		}
+	}
+
+	var deltas int
+
+	for _, p := range r.packObjects {
+		if r.packs[bundlePack].data[p.offset]>>4&7 == ObjectRefDelta {
+			deltas++
+		}
+	}
+
+	if deltas == 0 {
+		t.Error("expecting bundle to contain ref deltas")
+	}
+}
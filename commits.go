@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FileDiff struct {
+	Change
+	*BlobDiff
+}
+
+func (f *FileDiff) Unified() string {
+	from, to := f.OldPath, f.Path
+
+	if f.OldID == "" {
+		from = ""
+	} else if from == "" {
+		from = f.Path
+	}
+
+	if f.NewID == "" {
+		to = ""
+	}
+
+	return f.BlobDiff.Unified(from, to)
+}
+
+type CommitInfo struct {
+	Repo           string
+	Commit         *Commit
+	Parents        []*Commit
+	Files          []*FileDiff
+	Added, Deleted int
+}
+
+func getCommitInfo(repo string, r *Repo, c *Commit) (*CommitInfo, error) {
+	info := &CommitInfo{
+		Repo:    repo,
+		Commit:  c,
+		Parents: make([]*Commit, len(c.Parents)),
+	}
+
+	for n, p := range c.Parents {
+		pc, err := r.GetCommit(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading parent commit: %w", err)
+		}
+
+		info.Parents[n] = pc
+	}
+
+	var from string
+
+	if len(info.Parents) > 0 {
+		from = info.Parents[0].Tree
+	}
+
+	changes, err := r.DiffTrees(from, c.Tree)
+	if err != nil {
+		return nil, fmt.Errorf("error diffing trees: %w", err)
+	}
+
+	if config.RenameThreshold > 0 {
+		if changes, err = r.DetectRenames(changes, config.RenameThreshold, config.DetectCopies); err != nil {
+			return nil, fmt.Errorf("error detecting renames: %w", err)
+		}
+	}
+
+	info.Files = make([]*FileDiff, len(changes))
+
+	for n, change := range changes {
+		d, err := r.DiffBlobs(change.OldID, change.NewID, config.DiffContext)
+		if err != nil {
+			return nil, fmt.Errorf("error diffing %s: %w", change.Path, err)
+		}
+
+		info.Files[n] = &FileDiff{
+			Change:   change,
+			BlobDiff: d,
+		}
+		info.Added += d.Added
+		info.Deleted += d.Deleted
+	}
+
+	return info, nil
+}
+
+func buildCommits(repo string, r *Repo, commits []*Commit) error {
+	dir := filepath.Join(config.OutputDir, repo, "commit")
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating commit directory: %w", err)
+	}
+
+	wanted := make(map[string]struct{}, len(commits))
+
+	for _, c := range commits {
+		outpath := filepath.Join(dir, c.ID+".html")
+		wanted[c.ID+".html"] = struct{}{}
+
+		if !force {
+			fi, err := os.Stat(outpath)
+			if err == nil && fi.ModTime().Equal(c.Time) {
+				continue
+			} else if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error stat'ing commit file: %w", err)
+			}
+		}
+
+		if err := buildCommit(repo, r, c, outpath); err != nil {
+			return fmt.Errorf("error building commit %s: %w", c.ID, err)
+		}
+	}
+
+	// commits that are no longer in the history, such as after a force push,
+	// have their pages removed
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading commit directory: %w", err)
+	}
+
+	for _, f := range files {
+		if _, ok := wanted[f.Name()]; !ok && strings.HasSuffix(f.Name(), ".html") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return fmt.Errorf("error removing old commit page: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func buildCommit(repo string, r *Repo, c *Commit, outpath string) error {
+	info, err := getCommitInfo(repo, r, c)
+	if err != nil {
+		return err
+	}
+
+	f, err := createOutput(outpath)
+	if err != nil {
+		return fmt.Errorf("error creating commit file: %w", err)
+	}
+
+	if err := config.commitTemplate.Execute(f, info); err != nil {
+		f.Close()
+
+		return fmt.Errorf("error processing commit template: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing commit file: %w", err)
+	}
+
+	if err := os.Chtimes(outpath, c.Time, c.Time); err != nil {
+		return fmt.Errorf("error setting commit file time: %w", err)
+	}
+
+	return nil
+}
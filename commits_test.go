@@ -0,0 +1,105 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuildCommits(t *testing.T) {
+	gitDir := testGitRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	config.commitTemplate = template.Must(template.New("commit").Parse("{{.Commit.ID}} {{len .Parents}} +{{.Added}} -{{.Deleted}}"))
+
+	r := OpenRepo(gitDir)
+
+	commits, err := r.walkLog(testGit(t, gitDir, "rev-parse", "main"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	dir := filepath.Join(config.OutputDir, "repo", "commit")
+	stale := commits[1].ID + ".html"
+
+	writeFiles(t, dir, map[string]string{
+		testID1 + ".html": "gone",
+		stale:             "stale",
+		"notes.txt":       "kept",
+	})
+
+	if err := buildCommits("repo", r, commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var files []string
+
+	entries, _ := os.ReadDir(dir)
+
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+
+	expected := []string{commits[0].ID + ".html", commits[1].ID + ".html", "notes.txt"}
+
+	sort.Strings(expected)
+
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expecting files %v, got %v", expected, files)
+	}
+
+	for n, c := range commits {
+		path := filepath.Join(dir, c.ID+".html")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		parents := "1 +1 -0"
+		if n == len(commits)-1 {
+			parents = "0 +101 -0"
+		}
+
+		if page := c.ID + " " + parents; string(data) != page {
+			t.Errorf("expecting page %q, got %q", page, data)
+		}
+
+		if fi, err := os.Stat(path); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		} else if !fi.ModTime().Equal(c.Time) {
+			t.Errorf("expecting page time %s, got %s", c.Time, fi.ModTime())
+		}
+	}
+
+	// a page with its commit time is assumed to be complete, and is kept
+	path := filepath.Join(dir, commits[0].ID+".html")
+
+	os.WriteFile(path, []byte("kept"), 0o644)
+	os.Chtimes(path, commits[0].Time, commits[0].Time)
+
+	if err := buildCommits("repo", r, commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != "kept" {
+		t.Errorf("expecting up-to-date page to be kept, got %q", data)
+	}
+
+	os.Chtimes(path, time.Now(), time.Now())
+
+	if err := buildCommits("repo", r, commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) == "kept" {
+		t.Error("expecting page with the wrong time to be rebuilt")
+	}
+}
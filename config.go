@@ -38,14 +38,50 @@ var (
 		PrettyPrint                                 []string `json:"prettyPrint"`
 		PrettyTemplate                              string   `json:"prettyTemplate"`
 		PrettyTemplateFile                          string   `json:"prettyTemplateFile"`
+		CommitTemplate                              string   `json:"commitTemplate"`
+		CommitTemplateFile                          string   `json:"commitTemplateFile"`
+		DiffContext                                 int      `json:"diffContext"`
+		LogTemplate                                 string   `json:"logTemplate"`
+		LogTemplateFile                             string   `json:"logTemplateFile"`
+		LogPageSize                                 int      `json:"logPageSize"`
+		HistoryTemplate                             string   `json:"historyTemplate"`
+		HistoryTemplateFile                         string   `json:"historyTemplateFile"`
+		FollowRenames                               bool     `json:"followRenames"`
+		Blame                                       bool     `json:"blame"`
+		DirTemplate                                 string   `json:"dirTemplate"`
+		DirTemplateFile                             string   `json:"dirTemplateFile"`
+		DirIndexFile                                string   `json:"dirIndexFile"`
+		RawDir                                      string   `json:"rawDir"`
+		StoreDir                                    string   `json:"storeDir"`
+		ArchiveFormats                              []string `json:"archiveFormats"`
+		DumbHTTP                                    bool     `json:"dumbHTTP"`
+		BaseURL                                     string   `json:"baseURL"`
+		FeedSize                                    int      `json:"feedSize"`
+		JSONAPI                                     bool     `json:"jsonAPI"`
+		SearchIndex                                 bool     `json:"searchIndex"`
+		Bundle                                      bool     `json:"bundle"`
+		SnapshotTags                                bool     `json:"snapshotTags"`
+		SnapshotCommits                             bool     `json:"snapshotCommits"`
+		NoReplaceObjects                            bool     `json:"noReplaceObjects"`
+		RenameThreshold                             int      `json:"renameThreshold"`
+		DetectCopies                                bool     `json:"detectCopies"`
 		indexTemplate, repoTemplate, prettyTemplate *template.Template
+		commitTemplate, logTemplate                 *template.Template
+		historyTemplate, dirTemplate                *template.Template
 		prettyMap                                   map[string]parser.TokenFunc
 	}{
-		ReposDir:  "./",
-		OutputDir: ".",
-		GitDir:    ".git",
-		IndexFile: "index.html",
-		prettyMap: make(map[string]parser.TokenFunc),
+		ReposDir:        "./",
+		OutputDir:       ".",
+		GitDir:          ".git",
+		IndexFile:       "index.html",
+		DirIndexFile:    "index.html",
+		RawDir:          "raw",
+		StoreDir:        ".store",
+		DiffContext:     3,
+		LogPageSize:     50,
+		FeedSize:        20,
+		RenameThreshold: 50,
+		prettyMap:       make(map[string]parser.TokenFunc),
 	}
 	prettyPrinters = map[string]parser.TokenFunc{
 		".go": commentsPlain,
@@ -119,6 +155,74 @@ func readConfig(configFile string) error {
 		config.PrettyTemplate = string(b)
 	}
 
+	if config.CommitTemplateFile != "" {
+		f, err := os.Open(config.CommitTemplateFile)
+		if err != nil {
+			return fmt.Errorf("error opening commit template file: %w", err)
+		}
+
+		b, err := io.ReadAll(f)
+
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading commit template file: %w", err)
+		}
+
+		config.CommitTemplate = string(b)
+	}
+
+	if config.LogTemplateFile != "" {
+		f, err := os.Open(config.LogTemplateFile)
+		if err != nil {
+			return fmt.Errorf("error opening log template file: %w", err)
+		}
+
+		b, err := io.ReadAll(f)
+
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading log template file: %w", err)
+		}
+
+		config.LogTemplate = string(b)
+	}
+
+	if config.HistoryTemplateFile != "" {
+		f, err := os.Open(config.HistoryTemplateFile)
+		if err != nil {
+			return fmt.Errorf("error opening history template file: %w", err)
+		}
+
+		b, err := io.ReadAll(f)
+
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading history template file: %w", err)
+		}
+
+		config.HistoryTemplate = string(b)
+	}
+
+	if config.DirTemplateFile != "" {
+		f, err := os.Open(config.DirTemplateFile)
+		if err != nil {
+			return fmt.Errorf("error opening directory template file: %w", err)
+		}
+
+		b, err := io.ReadAll(f)
+
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading directory template file: %w", err)
+		}
+
+		config.DirTemplate = string(b)
+	}
+
 	if config.indexTemplate, err = template.New("index").Funcs(fMap).Parse(config.IndexTemplate); err != nil {
 		return fmt.Errorf("error parsing index template: %w", err)
 	}
@@ -131,6 +235,26 @@ func readConfig(configFile string) error {
 		return fmt.Errorf("error parsing pretty template: %w", err)
 	}
 
+	if config.commitTemplate, err = template.New("commit").Funcs(fMap).Parse(config.CommitTemplate); err != nil {
+		return fmt.Errorf("error parsing commit template: %w", err)
+	}
+
+	if config.logTemplate, err = template.New("log").Funcs(fMap).Parse(config.LogTemplate); err != nil {
+		return fmt.Errorf("error parsing log template: %w", err)
+	}
+
+	if config.historyTemplate, err = template.New("history").Funcs(fMap).Parse(config.HistoryTemplate); err != nil {
+		return fmt.Errorf("error parsing history template: %w", err)
+	}
+
+	if config.dirTemplate, err = template.New("dir").Funcs(fMap).Parse(config.DirTemplate); err != nil {
+		return fmt.Errorf("error parsing directory template: %w", err)
+	}
+
+	if config.BaseURL != "" && !strings.HasSuffix(config.BaseURL, "/") {
+		config.BaseURL += "/"
+	}
+
 	for _, printer := range config.PrettyPrint {
 		if p, ok := prettyPrinters[printer]; ok {
 			config.prettyMap[printer] = p
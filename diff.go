@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"vimagination.zapto.org/memio"
+)
+
+const binaryCheckLength = 8000
+
+type LineType uint8
+
+const (
+	LineContext LineType = iota
+	LineAdded
+	LineDeleted
+)
+
+var lineTypeNames = [...]string{
+	"context",
+	"added",
+	"deleted",
+}
+
+func (l LineType) String() string {
+	if int(l) < len(lineTypeNames) {
+		return lineTypeNames[l]
+	}
+
+	return "unknown"
+}
+
+func (l LineType) prefix() byte {
+	switch l {
+	case LineAdded:
+		return '+'
+	case LineDeleted:
+		return '-'
+	}
+
+	return ' '
+}
+
+type DiffLine struct {
+	Type             LineType
+	Text             string
+	OldLine, NewLine int
+	NoNewline        bool
+}
+
+type Hunk struct {
+	OldStart, OldLines, NewStart, NewLines int
+	Lines                                  []DiffLine
+}
+
+func (h *Hunk) Header() string {
+	return "@@ -" + hunkRange(h.OldStart, h.OldLines) + " +" + hunkRange(h.NewStart, h.NewLines) + " @@"
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	} else if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+type BlobDiff struct {
+	Binary         bool
+	Added, Deleted int
+	Hunks          []Hunk
+}
+
+func (r *Repo) readBlob(id string) ([]byte, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	b, err := r.GetBlob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := b.(*memio.LimitedBuffer); ok {
+		return *m, nil
+	}
+
+	data, err := io.ReadAll(b)
+
+	b.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob: %w", err)
+	}
+
+	return data, nil
+}
+
+func isBinary(data []byte) bool {
+	if len(data) > binaryCheckLength {
+		data = data[:binaryCheckLength]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// DiffBlobs produces a line diff between the two blobs, grouping changes into
+// hunks with the given number of lines of context. An empty blob ID
+// represents an empty file.
+func (r *Repo) DiffBlobs(from, to string, context int) (*BlobDiff, error) {
+	a, err := r.readBlob(from)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := r.readBlob(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinary(a) || isBinary(b) {
+		return &BlobDiff{Binary: from != to}, nil
+	}
+
+	return diffLines(splitLines(a), splitLines(b), context), nil
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+
+	lines := make([]string, 0, bytes.Count(data, newLine)+1)
+
+	for len(data) > 0 {
+		p := bytes.IndexByte(data, '\n') + 1
+		if p == 0 {
+			p = len(data)
+		}
+
+		lines = append(lines, string(data[:p]))
+		data = data[p:]
+	}
+
+	return lines
+}
+
+type lineEdit struct {
+	typ      LineType
+	old, new int
+}
+
+func diffLines(a, b []string, context int) *BlobDiff {
+	edits := editScript(a, b)
+	d := new(BlobDiff)
+
+	for n := 0; n < len(edits); {
+		if edits[n].typ == LineContext {
+			n++
+
+			continue
+		}
+
+		start := n - context
+		if start < 0 {
+			start = 0
+		}
+
+		end := n
+
+		for end < len(edits) {
+			if edits[end].typ != LineContext {
+				end++
+
+				continue
+			}
+
+			next := end
+
+			for next < len(edits) && edits[next].typ == LineContext && next-end < 2*context {
+				next++
+			}
+
+			if next == len(edits) || edits[next].typ == LineContext {
+				break
+			}
+
+			end = next
+		}
+
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		h := Hunk{
+			OldStart: edits[start].old + 1,
+			NewStart: edits[start].new + 1,
+			Lines:    make([]DiffLine, 0, stop-start),
+		}
+
+		for _, e := range edits[start:stop] {
+			var line string
+
+			dl := DiffLine{Type: e.typ}
+
+			if e.typ != LineAdded {
+				line = a[e.old]
+				h.OldLines++
+				dl.OldLine = e.old + 1
+			}
+
+			if e.typ != LineDeleted {
+				line = b[e.new]
+				h.NewLines++
+				dl.NewLine = e.new + 1
+			}
+
+			switch e.typ {
+			case LineAdded:
+				d.Added++
+			case LineDeleted:
+				d.Deleted++
+			}
+
+			dl.Text = strings.TrimSuffix(line, "\n")
+			dl.NoNewline = len(dl.Text) == len(line)
+			h.Lines = append(h.Lines, dl)
+		}
+
+		d.Hunks = append(d.Hunks, h)
+		n = stop
+	}
+
+	return d
+}
+
+func editScript(a, b []string) []lineEdit {
+	ids := make(map[string]int)
+	m := myers{
+		a:       internLines(a, ids),
+		b:       internLines(b, ids),
+		deleted: make([]bool, len(a)),
+		added:   make([]bool, len(b)),
+	}
+
+	m.compare(0, len(a), 0, len(b))
+
+	edits := make([]lineEdit, 0, len(a)+len(b))
+
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		for ; i < len(a) && m.deleted[i]; i++ {
+			edits = append(edits, lineEdit{typ: LineDeleted, old: i, new: j})
+		}
+
+		for ; j < len(b) && m.added[j]; j++ {
+			edits = append(edits, lineEdit{typ: LineAdded, old: i, new: j})
+		}
+
+		if i < len(a) && j < len(b) {
+			edits = append(edits, lineEdit{typ: LineContext, old: i, new: j})
+			i++
+			j++
+		}
+	}
+
+	return edits
+}
+
+func internLines(lines []string, ids map[string]int) []int {
+	interned := make([]int, len(lines))
+
+	for n, line := range lines {
+		id, ok := ids[line]
+		if !ok {
+			id = len(ids)
+			ids[line] = id
+		}
+
+		interned[n] = id
+	}
+
+	return interned
+}
+
+type myers struct {
+	a, b           []int
+	deleted, added []bool
+}
+
+func (m *myers) compare(a0, a1, b0, b1 int) {
+	for a0 < a1 && b0 < b1 && m.a[a0] == m.b[b0] {
+		a0++
+		b0++
+	}
+
+	for a0 < a1 && b0 < b1 && m.a[a1-1] == m.b[b1-1] {
+		a1--
+		b1--
+	}
+
+	if a0 == a1 {
+		for ; b0 < b1; b0++ {
+			m.added[b0] = true
+		}
+	} else if b0 == b1 {
+		for ; a0 < a1; a0++ {
+			m.deleted[a0] = true
+		}
+	} else {
+		x, y := m.split(a0, a1, b0, b1)
+
+		m.compare(a0, x, b0, y)
+		m.compare(x, a1, y, b1)
+	}
+}
+
+// split finds the middle snake of the two ranges, returning the point at which
+// it starts, which will always lie strictly within the ranges.
+func (m *myers) split(a0, a1, b0, b1 int) (int, int) {
+	n, l := a1-a0, b1-b0
+	max := (n+l+1)/2 + 1
+	delta := n - l
+	odd := delta&1 != 0
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+	offset := max + 1
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+
+			y := x - k
+			sx, sy := x, y
+
+			for x < n && y < l && m.a[a0+x] == m.b[b0+y] {
+				x++
+				y++
+			}
+
+			vf[offset+k] = x
+
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && x+vb[offset+kb] >= n {
+				return a0 + sx, b0 + sy
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				x = vb[offset+k+1]
+			} else {
+				x = vb[offset+k-1] + 1
+			}
+
+			y := x - k
+			sx, sy := x, y
+
+			for x < n && y < l && m.a[a1-1-x] == m.b[b1-1-y] {
+				x++
+				y++
+			}
+
+			vb[offset+k] = x
+
+			if kf := delta - k; !odd && kf >= -d && kf <= d && x+vf[offset+kf] >= n {
+				return a1 - sx, b1 - sy
+			}
+		}
+	}
+
+	return a0 + n/2, b0 + l/2
+}
+
+func (d *BlobDiff) WriteUnified(w io.Writer, from, to string) error {
+	if from == "" {
+		from = "/dev/null"
+	} else {
+		from = "a/" + from
+	}
+
+	if to == "" {
+		to = "/dev/null"
+	} else {
+		to = "b/" + to
+	}
+
+	if d.Binary {
+		_, err := fmt.Fprintf(w, "Binary files %s and %s differ\n", from, to)
+
+		return err
+	}
+
+	if len(d.Hunks) == 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to); err != nil {
+		return err
+	}
+
+	for _, h := range d.Hunks {
+		if _, err := io.WriteString(w, h.Header()+"\n"); err != nil {
+			return err
+		}
+
+		for _, l := range h.Lines {
+			if _, err := fmt.Fprintf(w, "%c%s\n", l.Type.prefix(), l.Text); err != nil {
+				return err
+			}
+
+			if l.NoNewline {
+				if _, err := io.WriteString(w, "\\ No newline at end of file\n"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *BlobDiff) Unified(from, to string) string {
+	var sb strings.Builder
+
+	d.WriteUnified(&sb, from, to)
+
+	return sb.String()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitLines(t *testing.T) {
+	for n, test := range [...]struct {
+		Data  string
+		Lines []string
+	}{
+		{},
+		{Data: "a", Lines: []string{"a"}},
+		{Data: "a\n", Lines: []string{"a\n"}},
+		{Data: "a\nb", Lines: []string{"a\n", "b"}},
+		{Data: "\n\n", Lines: []string{"\n", "\n"}},
+	} {
+		if lines := splitLines([]byte(test.Data)); !reflect.DeepEqual(lines, test.Lines) {
+			t.Errorf("test %d: expecting lines %q, got %q", n+1, test.Lines, lines)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	for n, test := range [...]struct {
+		A, B           string
+		Context        int
+		Added, Deleted int
+		Unified        string
+	}{
+		{ // 1
+			A: "a\nb\nc\n",
+			B: "a\nb\nc\n",
+		},
+		{ // 2
+			B:       "a\nb\n",
+			Context: 3,
+			Added:   2,
+			Unified: "--- a/f\n+++ b/f\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{ // 3
+			A:       "a\nb\n",
+			Context: 3,
+			Deleted: 2,
+			Unified: "--- a/f\n+++ b/f\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{ // 4
+			A:       "a\nb\nc\nd\ne\n",
+			B:       "a\nb\nC\nd\ne\n",
+			Context: 1,
+			Added:   1,
+			Deleted: 1,
+			Unified: "--- a/f\n+++ b/f\n@@ -2,3 +2,3 @@\n b\n-c\n+C\n d\n",
+		},
+		{ // 5
+			A:       "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			B:       "0\n1\n2\n3\n4\n5\n6\n7\n8\n",
+			Context: 1,
+			Added:   1,
+			Deleted: 1,
+			Unified: "--- a/f\n+++ b/f\n@@ -1 +1,2 @@\n+0\n 1\n@@ -8,2 +9 @@\n 8\n-9\n",
+		},
+		{ // 6
+			A:       "1\n2\n3\n4\n",
+			B:       "0\n2\n3\n5\n",
+			Context: 1,
+			Added:   2,
+			Deleted: 2,
+			Unified: "--- a/f\n+++ b/f\n@@ -1,4 +1,4 @@\n-1\n+0\n 2\n 3\n-4\n+5\n",
+		},
+		{ // 7
+			A:       "a\nb",
+			B:       "a\nb\n",
+			Context: 3,
+			Added:   1,
+			Deleted: 1,
+			Unified: "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{ // 8
+			A:       "a\nb\nc\nb\na\n",
+			B:       "b\na\nc\na\nb\n",
+			Context: 0,
+			Added:   2,
+			Deleted: 2,
+			Unified: "--- a/f\n+++ b/f\n@@ -1 +0,0 @@\n-a\n@@ -2,0 +2 @@\n+a\n@@ -4 +3,0 @@\n-b\n@@ -5,0 +5 @@\n+b\n",
+		},
+	} {
+		d := diffLines(splitLines([]byte(test.A)), splitLines([]byte(test.B)), test.Context)
+
+		if d.Added != test.Added || d.Deleted != test.Deleted {
+			t.Errorf("test %d: expecting +%d -%d, got +%d -%d", n+1, test.Added, test.Deleted, d.Added, d.Deleted)
+		}
+
+		if unified := d.Unified("f", "f"); unified != test.Unified {
+			t.Errorf("test %d: expecting unified diff:\n%s\ngot:\n%s", n+1, test.Unified, unified)
+		}
+	}
+}
+
+func TestDiffBlobs(t *testing.T) {
+	dir := t.TempDir()
+	text := testObject(t, dir, ObjectBlob, "a\n")
+	binary := testObject(t, dir, ObjectBlob, "a\x00b")
+	r := OpenRepo(dir)
+
+	if d, err := r.DiffBlobs(text, binary, 3); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if !d.Binary {
+		t.Error("expecting binary diff")
+	} else if unified := d.Unified("f", ""); unified != "Binary files a/f and /dev/null differ\n" {
+		t.Errorf("unexpected binary diff output: %q", unified)
+	}
+
+	if d, err := r.DiffBlobs("", text, 3); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if unified := d.Unified("", "f"); unified != "--- /dev/null\n+++ b/f\n@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("unexpected diff output: %q", unified)
+	}
+}
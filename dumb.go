@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// infoRefs returns the refs of the repository in the format of the info/refs
+// file, as written by git update-server-info.
+func (r *Repo) infoRefs() ([]byte, error) {
+	refs, err := r.listRefs("refs/")
+	if err != nil {
+		return nil, fmt.Errorf("error reading refs: %w", err)
+	}
+
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+
+	for _, name := range names {
+		id := refs[name]
+
+		fmt.Fprintf(&buf, "%s\t%s\n", id, name)
+
+		if strings.HasPrefix(name, "refs/tags/") {
+			peeled, _, err := r.peel(id)
+			if err != nil {
+				return nil, fmt.Errorf("error peeling %s: %w", name, err)
+			} else if peeled != id {
+				fmt.Fprintf(&buf, "%s\t%s^{}\n", peeled, name)
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// objectFiles returns the paths, relative to the git directory, of the loose
+// objects and of the packs, with their indexes, in the repository.
+func (r *Repo) objectFiles() ([]string, []string, error) {
+	var loose, packs []string
+
+	dirs, err := os.ReadDir(filepath.Join(r.path, "objects"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading objects directory: %w", err)
+	}
+
+	for _, d := range dirs {
+		if name := d.Name(); d.IsDir() && len(name) == 2 && checkSHA([]byte(name)) != "" {
+			objects, err := os.ReadDir(filepath.Join(r.path, "objects", name))
+			if err != nil {
+				return nil, nil, fmt.Errorf("error reading objects directory: %w", err)
+			}
+
+			for _, o := range objects {
+				if len(o.Name()) == 38 && checkSHA([]byte(o.Name())) != "" {
+					loose = append(loose, "objects/"+name+"/"+o.Name())
+				}
+			}
+		}
+	}
+
+	files, err := os.ReadDir(filepath.Join(r.path, "objects", "pack"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("error reading pack directory: %w", err)
+	}
+
+	for _, f := range files {
+		if name := f.Name(); strings.HasPrefix(name, "pack-") && strings.HasSuffix(name, ".pack") {
+			if _, err := os.Stat(filepath.Join(r.path, "objects", "pack", name[:len(name)-4]+"idx")); err == nil {
+				packs = append(packs, "objects/pack/"+name)
+			}
+		}
+	}
+
+	return loose, packs, nil
+}
+
+func dumbPath(repo string) string {
+	return filepath.Join(config.OutputDir, repo+".git")
+}
+
+// buildDumbHTTP mirrors the objects and refs of the repository into a
+// directory that can be cloned over the dumb HTTP protocol. As objects and
+// packs never change, only new ones are copied.
+func buildDumbHTTP(repo string, r *Repo) error {
+	base := dumbPath(repo)
+
+	loose, packs, err := r.objectFiles()
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]struct{}{"objects/info/packs": {}}
+
+	var packsInfo bytes.Buffer
+
+	for _, p := range packs {
+		idx := p[:len(p)-4] + "idx"
+		wanted[p] = struct{}{}
+		wanted[idx] = struct{}{}
+
+		fmt.Fprintf(&packsInfo, "P %s\n", p[len("objects/pack/"):])
+	}
+
+	packsInfo.WriteByte('\n')
+
+	for _, p := range append(loose, packs...) {
+		wanted[p] = struct{}{}
+	}
+
+	for p := range wanted {
+		if p == "objects/info/packs" {
+			continue
+		}
+
+		if err := linkObject(filepath.Join(r.path, filepath.FromSlash(p)), filepath.Join(base, filepath.FromSlash(p))); err != nil {
+			return err
+		}
+	}
+
+	head, err := r.readHeadRef()
+	if err != nil {
+		return err
+	}
+
+	infoRefs, err := r.infoRefs()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range [...]struct {
+		path string
+		data []byte
+	}{
+		{"objects/info/packs", packsInfo.Bytes()},
+		{"info/refs", infoRefs},
+		{"HEAD", []byte("ref: " + head + "\n")},
+	} {
+		if err := writeIfChanged(filepath.Join(base, filepath.FromSlash(f.path)), f.data); err != nil {
+			return err
+		}
+	}
+
+	objects := filepath.Join(base, "objects")
+
+	return filepath.WalkDir(objects, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := wanted[filepath.ToSlash(rel)]; !ok {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing object: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func linkObject(from, to string) error {
+	fi, err := os.Stat(to)
+	if err == nil {
+		sfi, err := os.Stat(from)
+		if err != nil {
+			return fmt.Errorf("error stat'ing object: %w", err)
+		} else if os.SameFile(fi, sfi) || fi.Size() == sfi.Size() {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error stat'ing object: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return fmt.Errorf("error creating object directory: %w", err)
+	}
+
+	os.Remove(to)
+
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+
+	return copyFile(from, to)
+}
+
+func writeIfChanged(path string, data []byte) error {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, data) {
+		return nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+
+	return nil
+}
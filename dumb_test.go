@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildDumbHTTP(t *testing.T) {
+	gitDir, ids := testTagRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	dir := filepath.Dir(gitDir)
+
+	testGit(t, gitDir, "repack", "-q", "-a", "-d")
+	writeFiles(t, dir, map[string]string{"loose.txt": "loose\n"})
+	testGit(t, dir, "add", ".")
+	testGit(t, dir, "commit", "-q", "-m", "c8")
+	testGit(t, gitDir, "update-server-info")
+
+	r := OpenRepo(gitDir)
+	base := dumbPath("repo")
+
+	writeFiles(t, base, map[string]string{"objects/ab/" + testID1[2:]: "stale"})
+
+	if err := buildDumbHTTP("repo", r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, p := range [...]string{"info/refs", "objects/info/packs"} {
+		expected, err := os.ReadFile(filepath.Join(gitDir, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if data, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(p))); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if string(data) != string(expected) {
+			t.Errorf("expecting %s to match git update-server-info:\n%s\ngot:\n%s", p, expected, data)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(base, "HEAD")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if string(data) != "ref: refs/heads/main\n" {
+		t.Errorf("expecting HEAD to point to main, got %q", data)
+	}
+
+	if fileExists(filepath.Join(base, "objects", "ab", testID1[2:])) {
+		t.Error("expecting object not in the repo to be removed")
+	}
+
+	s := httptest.NewServer(http.FileServer(http.Dir(config.OutputDir)))
+	defer s.Close()
+
+	clone := filepath.Join(t.TempDir(), "clone")
+
+	cmd := exec.Command("git", "clone", "-q", "--mirror", s.URL+"/repo.git", clone)
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_TERMINAL_PROMPT=0", "NO_PROXY=*")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git clone failed: %s\n%s", err, out)
+	}
+
+	testGit(t, clone, "fsck", "--strict")
+
+	if refs, expected := testGit(t, clone, "show-ref", "--head", "--dereference"), testGit(t, gitDir, "show-ref", "--head", "--dereference"); refs != expected {
+		t.Errorf("expecting cloned refs:\n%s\ngot:\n%s", expected, refs)
+	}
+
+	if tip := testGit(t, clone, "rev-parse", "v3^{commit}"); tip != ids["c4"] {
+		t.Errorf("expecting nested tag to point to %s, got %s", ids["c4"], tip)
+	}
+}
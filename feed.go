@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Author    atomPerson `xml:"author"`
+	Links     []atomLink `xml:"link"`
+	Content   *atomText  `xml:"content,omitempty"`
+}
+
+func atomTime(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
+
+func newFeed(title, path, alternate string, updated time.Time) *atomFeed {
+	return &atomFeed{
+		Title:   title,
+		ID:      config.BaseURL + path,
+		Updated: atomTime(updated),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: config.BaseURL + path},
+			{Rel: "alternate", Href: config.BaseURL + alternate},
+		},
+	}
+}
+
+// commitURL returns the page for a commit, which is the repo page when commit
+// pages aren't being built.
+func commitURL(repo string, c *Commit) string {
+	if config.CommitTemplate == "" {
+		return config.BaseURL + repo + "/"
+	}
+
+	return config.BaseURL + repo + "/commit/" + c.ID + ".html"
+}
+
+func commitEntry(repo string, c *Commit, title string) atomEntry {
+	return atomEntry{
+		Title:     title,
+		ID:        config.BaseURL + repo + "/commit/" + c.ID + ".html",
+		Updated:   atomTime(c.Time),
+		Published: atomTime(c.AuthorTime),
+		Author:    atomPerson{Name: c.Author, Email: c.AuthorEmail},
+		Links:     []atomLink{{Rel: "alternate", Href: commitURL(repo, c)}},
+		Content:   &atomText{Type: "text", Body: c.Msg},
+	}
+}
+
+// tagTime returns the time of an annotated tag, or of the commit for a
+// lightweight tag.
+func tagTime(t *Tag) time.Time {
+	if t.Type == ObjectTag && !t.Time.IsZero() {
+		return t.Time
+	}
+
+	return t.Commit.Time
+}
+
+func tagEntry(repo string, t *Tag, archives []Archive) atomEntry {
+	e := atomEntry{
+		Title:   t.Name,
+		ID:      config.BaseURL + repo + "/tags.atom#" + url.PathEscape(t.Name),
+		Updated: atomTime(tagTime(t)),
+		Author:  atomPerson{Name: t.Commit.Author, Email: t.Commit.AuthorEmail},
+		Links:   []atomLink{{Rel: "alternate", Href: commitURL(repo, t.Commit)}},
+	}
+
+	if config.SnapshotTags {
+		e.Links[0].Href = config.BaseURL + repo + "/" + snapshotPath(t.Commit.ID)
+	}
+
+	if t.Type == ObjectTag {
+		if t.Tagger != "" {
+			e.Author = atomPerson{Name: t.Tagger, Email: t.TaggerEmail}
+		}
+
+		if t.Msg != "" {
+			e.Title += ": " + t.Subject()
+			e.Content = &atomText{Type: "text", Body: t.Msg}
+		}
+	}
+
+	for _, a := range archives {
+		if a.Ref == t.Name {
+			e.Links = append(e.Links, atomLink{Rel: "enclosure", Href: config.BaseURL + repo + "/" + a.Path})
+		}
+	}
+
+	return e
+}
+
+func writeFeed(path string, feed *atomFeed) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "\t")
+
+	if err := enc.Encode(feed); err != nil {
+		return fmt.Errorf("error encoding feed: %w", err)
+	}
+
+	buf.WriteByte('\n')
+
+	return writeIfChanged(path, buf.Bytes())
+}
+
+// buildFeeds writes Atom feeds of the most recent commits and tags of a repo.
+func buildFeeds(repo string, r *Repo, head *Commit, tags []*Tag, archives []Archive) error {
+	commits, err := r.walkLogLimit(head.ID, config.FeedSize)
+	if err != nil {
+		return err
+	}
+
+	feed := newFeed(repo+" commits", repo+"/commits.atom", repo+"/", head.Time)
+
+	for _, c := range commits {
+		feed.Entries = append(feed.Entries, commitEntry(repo, c, c.Subject()))
+	}
+
+	if err := writeFeed(filepath.Join(config.OutputDir, repo, "commits.atom"), feed); err != nil {
+		return err
+	}
+
+	feed = newFeed(repo+" tags", repo+"/tags.atom", repo+"/", head.Time)
+
+	var updated time.Time
+
+	for n, t := range tags {
+		if config.FeedSize > 0 && n == config.FeedSize {
+			break
+		} else if tt := tagTime(t); tt.After(updated) {
+			updated = tt
+		}
+
+		feed.Entries = append(feed.Entries, tagEntry(repo, t, archives))
+	}
+
+	if !updated.IsZero() {
+		feed.Updated = atomTime(updated)
+	}
+
+	return writeFeed(filepath.Join(config.OutputDir, repo, "tags.atom"), feed)
+}
+
+type repoCommit struct {
+	repo   string
+	commit *Commit
+}
+
+// buildSiteFeed writes an Atom feed of the most recent commits across all of
+// the repos.
+func buildSiteFeed(commits []repoCommit) error {
+	sort.SliceStable(commits, func(i, j int) bool {
+		return commits[i].commit.Time.After(commits[j].commit.Time)
+	})
+
+	if config.FeedSize > 0 && len(commits) > config.FeedSize {
+		commits = commits[:config.FeedSize]
+	}
+
+	var updated time.Time
+
+	if len(commits) > 0 {
+		updated = commits[0].commit.Time
+	}
+
+	feed := newFeed("Commits", "feed.atom", "", updated)
+
+	for _, c := range commits {
+		feed.Entries = append(feed.Entries, commitEntry(c.repo, c.commit, c.repo+": "+c.commit.Subject()))
+	}
+
+	return writeFeed(filepath.Join(config.OutputDir, "feed.atom"), feed)
+}
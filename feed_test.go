@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readFeed(t *testing.T, path string) *atomFeed {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var feed atomFeed
+
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatalf("unexpected error decoding feed: %s", err)
+	}
+
+	return &feed
+}
+
+func feedTitles(feed *atomFeed) []string {
+	var titles []string
+
+	for _, e := range feed.Entries {
+		titles = append(titles, e.Title)
+	}
+
+	return titles
+}
+
+func TestBuildSiteFeed(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.BaseURL = "https://example.com/"
+	config.CommitTemplate = "commit.tmpl"
+
+	base := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for n, test := range [...]struct {
+		FeedSize int
+		Titles   []string
+	}{
+		{FeedSize: -1, Titles: []string{"b: two", "a: three", "a: one"}},
+		{FeedSize: 0, Titles: []string{"b: two", "a: three", "a: one"}},
+		{FeedSize: 1, Titles: []string{"b: two"}},
+		{FeedSize: 2, Titles: []string{"b: two", "a: three"}},
+		{FeedSize: 5, Titles: []string{"b: two", "a: three", "a: one"}},
+	} {
+		config.OutputDir = t.TempDir()
+		config.FeedSize = test.FeedSize
+
+		if err := buildSiteFeed([]repoCommit{
+			{repo: "a", commit: &Commit{ID: testID1, Msg: "one\n\nbody", Time: base}},
+			{repo: "b", commit: &Commit{ID: testID2, Msg: "two", Time: base.Add(2 * time.Hour)}},
+			{repo: "a", commit: &Commit{ID: testID3, Msg: "three", Time: base.Add(time.Hour)}},
+		}); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		feed := readFeed(t, filepath.Join(config.OutputDir, "feed.atom"))
+
+		if titles := feedTitles(feed); !reflect.DeepEqual(titles, test.Titles) {
+			t.Errorf("test %d: expecting entries %q, got %q", n+1, test.Titles, titles)
+		}
+
+		if expected := atomTime(base.Add(2 * time.Hour)); feed.Updated != expected {
+			t.Errorf("test %d: expecting updated %s, got %s", n+1, expected, feed.Updated)
+		}
+
+		if expected := "https://example.com/b/commit/" + testID2 + ".html"; feed.Entries[0].Links[0].Href != expected {
+			t.Errorf("test %d: expecting link %s, got %s", n+1, expected, feed.Entries[0].Links[0].Href)
+		}
+	}
+}
+
+func TestTagEntry(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.BaseURL = "https://example.com/"
+
+	commitTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tagTime := commitTime.Add(time.Hour)
+	commit := &Commit{ID: testID1, Author: "Author", AuthorEmail: "author@example.com", Time: commitTime}
+
+	for n, test := range [...]struct {
+		Tag         Tag
+		Snapshots   bool
+		CommitPages bool
+		Archives    []Archive
+		Expected    atomEntry
+	}{
+		{ // 1
+			Tag: Tag{Name: "v1", Type: ObjectCommit, Commit: commit},
+			Expected: atomEntry{
+				Title:   "v1",
+				ID:      "https://example.com/repo/tags.atom#v1",
+				Updated: atomTime(commitTime),
+				Author:  atomPerson{Name: "Author", Email: "author@example.com"},
+				Links:   []atomLink{{Rel: "alternate", Href: "https://example.com/repo/"}},
+			},
+		},
+		{ // 2
+			Tag:         Tag{Name: "v 2", Type: ObjectTag, Tagger: "Tagger", Msg: "release\n\nnotes", Time: tagTime, Commit: commit},
+			CommitPages: true,
+			Archives: []Archive{
+				{Ref: "v 2", Path: "archive/v 2.tar.gz"},
+				{Ref: "v1", Path: "archive/v1.tar.gz"},
+			},
+			Expected: atomEntry{
+				Title:   "v 2: release",
+				ID:      "https://example.com/repo/tags.atom#v%202",
+				Updated: atomTime(tagTime),
+				Author:  atomPerson{Name: "Tagger"},
+				Links: []atomLink{
+					{Rel: "alternate", Href: "https://example.com/repo/commit/" + testID1 + ".html"},
+					{Rel: "enclosure", Href: "https://example.com/repo/archive/v 2.tar.gz"},
+				},
+				Content: &atomText{Type: "text", Body: "release\n\nnotes"},
+			},
+		},
+		{ // 3
+			Tag:       Tag{Name: "v3", Type: ObjectTag, Commit: commit},
+			Snapshots: true,
+			Expected: atomEntry{
+				Title:   "v3",
+				ID:      "https://example.com/repo/tags.atom#v3",
+				Updated: atomTime(commitTime),
+				Author:  atomPerson{Name: "Author", Email: "author@example.com"},
+				Links:   []atomLink{{Rel: "alternate", Href: "https://example.com/repo/" + snapshotPath(testID1)}},
+			},
+		},
+	} {
+		config.SnapshotTags = test.Snapshots
+		config.CommitTemplate = ""
+
+		if test.CommitPages {
+			config.CommitTemplate = "commit.tmpl"
+		}
+
+		if e := tagEntry("repo", &test.Tag, test.Archives); !reflect.DeepEqual(e, test.Expected) {
+			t.Errorf("test %d: expecting entry %+v, got %+v", n+1, test.Expected, e)
+		}
+	}
+}
+
+func TestBuildFeeds(t *testing.T) {
+	gitDir := testGitRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.BaseURL = "https://example.com/"
+
+	r := OpenRepo(gitDir)
+
+	head, err := r.GetCommit(testGit(t, gitDir, "rev-parse", "main"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		FeedSize      int
+		Commits, Tags int
+	}{
+		{FeedSize: 0, Commits: 2, Tags: 2},
+		{FeedSize: -1, Commits: 2, Tags: 2},
+		{FeedSize: 1, Commits: 1, Tags: 1},
+	} {
+		config.OutputDir = t.TempDir()
+		config.FeedSize = test.FeedSize
+
+		os.Mkdir(filepath.Join(config.OutputDir, "repo"), 0o755)
+
+		if err := buildFeeds("repo", r, head, tags, nil); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		commits := readFeed(t, filepath.Join(config.OutputDir, "repo", "commits.atom"))
+
+		if len(commits.Entries) != test.Commits {
+			t.Errorf("test %d: expecting %d commit entries, got %d", n+1, test.Commits, len(commits.Entries))
+		} else if commits.Entries[0].Title != "second" {
+			t.Errorf("test %d: expecting first commit entry to be %q, got %q", n+1, "second", commits.Entries[0].Title)
+		}
+
+		if tf := readFeed(t, filepath.Join(config.OutputDir, "repo", "tags.atom")); len(tf.Entries) != test.Tags {
+			t.Errorf("test %d: expecting %d tag entries, got %d", n+1, test.Tags, len(tf.Entries))
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,7 +22,8 @@ const (
 	ObjectCommit = 1
 	ObjectTree   = 2
 	ObjectBlob   = 3
-	// ObjectTag = 4
+	ObjectTag    = 4
+
 	ObjectOffsetDelta = 6
 	ObjectRefDelta    = 7
 )
@@ -98,15 +100,39 @@ type Repo struct {
 	packs       map[string]*pack
 	packObjects map[string]packObject
 
+	bundle         bool
+	loadBundleRefs sync.Once
+	bundleErr      error
+	bundleRefs     map[string]string
+
+	loadRefTable sync.Once
+	refTableErr  error
+	refTable     map[string]reftableRef
+
+	loadPackedRefs sync.Once
+	packedRefsErr  error
+	packedRefs     map[string]string
+
+	loadReplace sync.Once
+	noReplace   bool
+	replaceErr  error
+	replace     map[string]string
+	grafts      map[string][]string
+
 	cacheMu    sync.RWMutex
 	cache      map[string]interface{}
 	lastCommit string
 }
 
+// OpenRepo opens the git directory, or bundle file, at the given path.
 func OpenRepo(path string) *Repo {
+	fi, err := os.Stat(path)
+
 	return &Repo{
-		path:  path,
-		cache: make(map[string]interface{}),
+		path:      path,
+		cache:     make(map[string]interface{}),
+		noReplace: config.NoReplaceObjects || os.Getenv("GIT_NO_REPLACE_OBJECTS") != "",
+		bundle:    err == nil && fi.Mode().IsRegular(),
 	}
 }
 
@@ -133,6 +159,19 @@ func (r *Repo) GetDescription() string {
 }
 
 func (r *Repo) readHeadRef() (string, error) {
+	if r.bundle {
+		return r.bundleHead()
+	} else if r.hasRefTable() {
+		ref, err := r.readRefTableRef("HEAD")
+		if err != nil {
+			return "", fmt.Errorf("error reading HEAD: %w", err)
+		} else if ref.target == "" {
+			return "", errors.New("invalid HEAD ref")
+		}
+
+		return ref.target, nil
+	}
+
 	f, err := os.Open(filepath.Join(r.path, "HEAD"))
 	if err != nil {
 		return "", fmt.Errorf("error opening HEAD: %w", err)
@@ -172,8 +211,35 @@ func (r *Repo) GetLatestCommitID() (string, error) {
 		return "", err
 	}
 
-	f, err := os.Open(filepath.Join(r.path, head))
-	if err != nil {
+	if id, err = r.readRef(head); err != nil {
+		return "", err
+	}
+
+	r.cacheMu.Lock()
+	r.lastCommit = id
+	r.cacheMu.Unlock()
+
+	return id, nil
+}
+
+func (r *Repo) readRef(name string) (string, error) {
+	if r.bundle {
+		return r.readBundleRef(name)
+	} else if r.hasRefTable() {
+		ref, err := r.readRefTableRef(name)
+		if err != nil {
+			return "", fmt.Errorf("error reading ref: %w", err)
+		} else if ref.id == "" {
+			return "", errors.New("invalid id")
+		}
+
+		return ref.id, nil
+	}
+
+	f, err := os.Open(filepath.Join(r.path, name))
+	if os.IsNotExist(err) {
+		return r.readPackedRef(name)
+	} else if err != nil {
 		return "", fmt.Errorf("error opening ref: %w", err)
 	}
 
@@ -186,21 +252,23 @@ func (r *Repo) GetLatestCommitID() (string, error) {
 		return "", fmt.Errorf("error while reading ref: %w", err)
 	}
 
-	id = checkSHA(buf[:n-1])
+	id := checkSHA(buf[:n-1])
 	if id == "" {
 		return "", errors.New("invalid id")
 	}
 
-	r.cacheMu.Lock()
-	r.lastCommit = id
-	r.cacheMu.Unlock()
-
 	return id, nil
 }
 
 var newLine = []byte{'\n'}
 
 func (r *Repo) loadPacksData() {
+	if r.bundle {
+		r.loadBundleData()
+
+		return
+	}
+
 	f, err := os.Open(filepath.Join(r.path, "objects", "info", "packs"))
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -395,7 +463,7 @@ func (r *Repo) readPackOffset(p string, o uint64, want int) (io.ReadCloser, erro
 	var base io.ReadCloser
 
 	switch typ {
-	case ObjectCommit, ObjectTree, ObjectBlob:
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
 		z, err := decompress(pack)
 		if err != nil {
 			return nil, fmt.Errorf("error starting to decompress object: %w", err)
@@ -427,7 +495,12 @@ func (r *Repo) readPackOffset(p string, o uint64, want int) (io.ReadCloser, erro
 			return nil, fmt.Errorf("error reading delta ref: %w", err)
 		}
 
-		base, err = r.getObject(fmt.Sprintf("%x", ref[:]), want)
+		if r.bundle {
+			base, err = r.readBundleObject(fmt.Sprintf("%x", ref[:]), want)
+		} else {
+			base, err = r.readObject(fmt.Sprintf("%x", ref[:]), want)
+		}
+
 		if err != nil {
 			return nil, fmt.Errorf("error reading base object: %w", err)
 		}
@@ -548,7 +621,24 @@ func (r *Repo) readPackOffset(p string, o uint64, want int) (io.ReadCloser, erro
 }
 
 func (r *Repo) getObject(id string, want int) (io.ReadCloser, error) {
-	f, err := os.Open(filepath.Join(r.path, "objects", id[:2], id[2:]))
+	rid, err := r.replacement(id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading replacement object for %s: %w", id, err)
+	}
+
+	return r.readObject(rid, want)
+}
+
+func (r *Repo) openLoose(id string) (*os.File, error) {
+	if r.bundle {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(filepath.Join(r.path, "objects", id[:2], id[2:]))
+}
+
+func (r *Repo) readObject(id string, want int) (io.ReadCloser, error) {
+	f, err := r.openLoose(id)
 	if os.IsNotExist(err) {
 		r.loadPacks.Do(r.loadPacksData)
 
@@ -615,9 +705,181 @@ func (r *Repo) getObject(id string, want int) (io.ReadCloser, error) {
 	return z, nil
 }
 
+// ObjectType returns the type of the object with the given ID, following any
+// deltas to their base objects.
+func (r *Repo) ObjectType(id string) (int, error) {
+	rid, err := r.replacement(id)
+	if err != nil {
+		return 0, fmt.Errorf("error reading replacement object for %s: %w", id, err)
+	}
+
+	return r.readObjectType(rid)
+}
+
+func (r *Repo) readObjectType(id string) (int, error) {
+	f, err := r.openLoose(id)
+	if os.IsNotExist(err) {
+		r.loadPacks.Do(r.loadPacksData)
+
+		if r.packsErr != nil {
+			err = r.packsErr
+		} else if p, ok := r.packObjects[id]; ok {
+			return r.readPackType(p.pack, p.offset)
+		}
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("error opening object file (%s): %w", id, err)
+	}
+
+	z, err := decompress(f)
+	if err != nil {
+		f.Close()
+		return 0, fmt.Errorf("error decompressing object file (%s): %s", id, err)
+	}
+
+	defer z.Close()
+
+	buf := bufPool.Get().(*[21]byte)
+
+	defer bufPool.Put(buf)
+
+	for n := range buf {
+		if _, err := z.Read(buf[n : n+1]); err != nil {
+			return 0, fmt.Errorf("error reading object header: %w", err)
+		}
+
+		if buf[n] == ' ' {
+			for typ, header := range objectHeaders {
+				if header != "" && header == string(buf[:n+1]) {
+					return typ, nil
+				}
+			}
+
+			break
+		}
+	}
+
+	return 0, errors.New("invalid object type")
+}
+
+func (r *Repo) readPackType(p string, o uint64) (int, error) {
+	pd, ok := r.packs[p]
+	if !ok {
+		return 0, errors.New("invalid pack file")
+	}
+
+	pd.mu.RLock()
+	if po, ok := pd.objects[o]; ok {
+		pd.mu.RUnlock()
+
+		return po.typ, nil
+	}
+	pd.mu.RUnlock()
+
+	pack := memio.Open(pd.data)
+	if _, err := pack.Seek(int64(o), io.SeekStart); err != nil {
+		return 0, fmt.Errorf("error seeking to object offset: %w", err)
+	}
+
+	buf, err := pack.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("error reading pack object type: %w", err)
+	}
+
+	typ := int(buf>>4) & 7
+
+	for buf&0x80 != 0 {
+		if buf, err = pack.ReadByte(); err != nil {
+			return 0, fmt.Errorf("error reading pack object size: %w", err)
+		}
+	}
+
+	switch typ {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+		return typ, nil
+	case ObjectOffsetDelta:
+		ber := byteio.BigEndianReader{Reader: pack}
+
+		baseOffset, _, err := ber.ReadUintX()
+		if err != nil {
+			return 0, fmt.Errorf("error reading offset: %w", err)
+		}
+
+		if baseOffset >= o {
+			return 0, errors.New("invalid offset for OffsetDelta")
+		}
+
+		return r.readPackType(p, o-baseOffset)
+	case ObjectRefDelta:
+		var ref [20]byte
+
+		if _, err := pack.Read(ref[:]); err != nil {
+			return 0, fmt.Errorf("error reading delta ref: %w", err)
+		}
+
+		if r.bundle {
+			return r.readBundleObjectType(fmt.Sprintf("%x", ref[:]))
+		}
+
+		return r.readObjectType(fmt.Sprintf("%x", ref[:]))
+	}
+
+	return 0, errors.New("invalid pack type")
+}
+
 type Commit struct {
-	Tree, Parent, Msg string
-	Time              time.Time
+	ID, Tree, Parent, Msg     string
+	Parents                   []string
+	Author, AuthorEmail       string
+	Committer, CommitterEmail string
+	AuthorTime, Time          time.Time
+}
+
+func (c *Commit) Subject() string {
+	if p := strings.IndexByte(c.Msg, '\n'); p >= 0 {
+		return c.Msg[:p]
+	}
+
+	return c.Msg
+}
+
+func parseSignature(line []byte) (string, string, time.Time, error) {
+	z := bytes.LastIndexByte(line, ' ')
+	if z < 0 {
+		return "", "", time.Time{}, errors.New("invalid timezone")
+	}
+
+	zoneOffset, err := strconv.ParseInt(string(line[z+1:]), 10, 16)
+	if err != nil {
+		return "", "", time.Time{}, errors.New("invalid timezone string")
+	}
+
+	hours := zoneOffset / 100
+	mins := zoneOffset % 100
+
+	s := bytes.LastIndexByte(line[:z], ' ')
+	if s < 0 {
+		return "", "", time.Time{}, errors.New("invalid timestamp")
+	}
+
+	unix, err := strconv.ParseInt(string(line[s+1:z]), 10, 64)
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("invalid timestamp string: %w", err)
+	}
+
+	var name, email string
+
+	ident := line[:s]
+
+	if e := bytes.LastIndexByte(ident, '<'); e >= 0 {
+		name = string(bytes.TrimSpace(ident[:e]))
+		email = string(bytes.TrimSuffix(ident[e+1:], []byte{'>'}))
+	} else {
+		name = string(bytes.TrimSpace(ident))
+	}
+
+	return name, email, time.Unix(unix, 0).In(time.FixedZone("UTC", int(hours*3600+mins*60))), nil
 }
 
 func (r *Repo) GetCommit(id string) (*Commit, error) {
@@ -652,7 +914,7 @@ func (r *Repo) GetCommit(id string) (*Commit, error) {
 		}
 	}
 
-	c := new(Commit)
+	c := &Commit{ID: id}
 
 	for {
 		p := bytes.IndexByte(buf, '\n')
@@ -672,45 +934,37 @@ func (r *Repo) GetCommit(id string) (*Commit, error) {
 				}
 			}
 		} else if p > 7 && string(line[:7]) == "parent " {
-			if c.Parent == "" {
-				if c.Parent = checkSHA(line[7:]); c.Parent == "" {
-					return nil, errors.New("invalid parent SHA")
+			parent := checkSHA(line[7:])
+			if parent == "" {
+				return nil, errors.New("invalid parent SHA")
+			}
+
+			c.Parents = append(c.Parents, parent)
+		} else if p > 7 && string(line[:7]) == "author " {
+			if c.AuthorTime.IsZero() {
+				if c.Author, c.AuthorEmail, c.AuthorTime, err = parseSignature(line[7:]); err != nil {
+					return nil, err
 				}
 			}
 		} else if p > 10 && string(line[:10]) == "committer " {
 			if c.Time.IsZero() {
-				line = line[10:]
-
-				z := bytes.LastIndexByte(line, ' ')
-				if z < 0 {
-					return nil, errors.New("invalid timezone")
-				}
-
-				zoneOffset, err := strconv.ParseInt(string(line[z+1:]), 10, 16)
-				if err != nil {
-					return nil, errors.New("invalid timezone string")
-				}
-
-				hours := zoneOffset / 100
-				mins := zoneOffset % 100
-
-				s := bytes.LastIndexByte(line[:z], ' ')
-				if s < 0 {
-					return nil, errors.New("invalid timestamp")
-				}
-
-				unix, err := strconv.ParseInt(string(line[s+1:z]), 10, 64)
-				if err != nil {
-					return nil, fmt.Errorf("invalid timestamp string: %w", err)
+				if c.Committer, c.CommitterEmail, c.Time, err = parseSignature(line[10:]); err != nil {
+					return nil, err
 				}
-
-				c.Time = time.Unix(unix, 0).In(time.FixedZone("UTC", int(hours*3600+mins*60)))
 			}
 		}
 	}
 
 	c.Msg = string(buf[:len(buf)-1])
 
+	if parents, ok := r.graft(id); ok {
+		c.Parents = parents
+	}
+
+	if len(c.Parents) > 0 {
+		c.Parent = c.Parents[0]
+	}
+
 	r.cacheMu.Lock()
 	r.cache[id] = c
 	r.cacheMu.Unlock()
@@ -720,6 +974,17 @@ func (r *Repo) GetCommit(id string) (*Commit, error) {
 
 type Tree map[string]string
 
+const (
+	ModeDir     = 0o40000
+	ModeSymlink = 0o120000
+	ModeGitLink = 0o160000
+)
+
+type TreeEntry struct {
+	Name, ID string
+	Mode     uint32
+}
+
 func (r *Repo) GetTree(id string) (Tree, error) {
 	r.cacheMu.RLock()
 	co, ok := r.cache[id]
@@ -733,6 +998,35 @@ func (r *Repo) GetTree(id string) (Tree, error) {
 		return nil, errors.New("wrong type")
 	}
 
+	entries, err := r.GetTreeEntries(id)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(Tree, len(entries))
+
+	for _, e := range entries {
+		name := e.Name
+
+		if e.Mode == ModeDir {
+			name += "/"
+		} else if e.Mode == ModeSymlink {
+			name = "/" + name
+		}
+
+		files[name] = e.ID
+	}
+
+	r.cacheMu.Lock()
+	r.cache[id] = files
+	r.cacheMu.Unlock()
+
+	return files, nil
+}
+
+// GetTreeEntries returns the entries of a tree, with their modes, in the order
+// they are stored.
+func (r *Repo) GetTreeEntries(id string) ([]TreeEntry, error) {
 	o, err := r.getObject(id, ObjectTree)
 	if err != nil {
 		return nil, fmt.Errorf("error while opening tree object: %w", err)
@@ -752,7 +1046,11 @@ func (r *Repo) GetTree(id string) (Tree, error) {
 		}
 	}
 
-	files := make(Tree)
+	return parseTreeEntries(buf)
+}
+
+func parseTreeEntries(buf []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
 
 	for len(buf) > 0 {
 		p := bytes.IndexByte(buf, ' ')
@@ -760,32 +1058,31 @@ func (r *Repo) GetTree(id string) (Tree, error) {
 			return nil, errors.New("unable to read file mode")
 		}
 
-		mode := buf[:p]
+		mode, err := strconv.ParseUint(string(buf[:p]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file mode: %w", err)
+		}
+
 		buf = buf[p+1:]
 
 		p = bytes.IndexByte(buf, 0)
-		if p == -1 {
+		if p == -1 || len(buf) < p+21 {
 			return nil, errors.New("unable to read file mode")
 		}
 
 		name := string(buf[:p])
+		buf = buf[p+1:]
 
-		if string(mode) == "40000" {
-			name += "/"
-		} else if string(mode) == "120000" {
-			name = "/" + name
-		}
+		entries = append(entries, TreeEntry{
+			Name: name,
+			ID:   fmt.Sprintf("%x", buf[:20]),
+			Mode: uint32(mode),
+		})
 
-		buf = buf[p+1:]
-		files[name] = fmt.Sprintf("%x", buf[:20])
 		buf = buf[20:]
 	}
 
-	r.cacheMu.Lock()
-	r.cache[id] = files
-	r.cacheMu.Unlock()
-
-	return files, nil
+	return entries, nil
 }
 
 func (r *Repo) GetBlob(id string) (io.ReadCloser, error) {
@@ -12,9 +12,8 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
-
-	"vimagination.zapto.org/parser"
 )
 
 var force bool
@@ -31,6 +30,7 @@ func main() {
 	configFile := flag.String("c", filepath.Join(u.HomeDir, ".gitweb"), "config file location")
 	gitDir := flag.String("r", "", "git repo to build")
 	noIndex := flag.Bool("n", false, "no main index")
+	serveAddr := flag.String("s", "", "serve the output directory, and smart HTTP clones, on the given address")
 
 	flag.Parse()
 
@@ -44,6 +44,11 @@ func main() {
 			fmt.Fprintf(os.Stderr, "error building repo: %s\n", err)
 			os.Exit(3)
 		}
+
+		if err := pruneStore(); err != nil {
+			fmt.Fprintf(os.Stderr, "error pruning store: %s\n", err)
+			os.Exit(3)
+		}
 	}
 
 	if !*noIndex {
@@ -52,66 +57,13 @@ func main() {
 			os.Exit(4)
 		}
 	}
-}
-
-func getFileLastCommit(r *Repo, path []string) (*Commit, error) {
-	cid, err := r.GetLatestCommitID()
-	if err != nil {
-		return nil, fmt.Errorf("error reading last commit id: %w", err)
-	}
-
-	last, err := r.GetCommit(cid)
-	if err != nil {
-		return nil, fmt.Errorf("error reading commit: %w", err)
-	}
-
-	objID := last.Tree
-
-	for _, p := range path {
-		t, err := r.GetTree(objID)
-		if err != nil {
-			return nil, fmt.Errorf("error reading tree: %w", err)
-		}
 
-		nID, ok := t[p]
-		if !ok {
-			return nil, errors.New("invalid file")
+	if *serveAddr != "" {
+		if err := serve(*serveAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "error serving: %s\n", err)
+			os.Exit(5)
 		}
-
-		objID = nID
 	}
-
-	for cid != "" {
-		c, err := r.GetCommit(cid)
-		if err != nil {
-			return nil, fmt.Errorf("error reading commit: %w", err)
-		}
-
-		tID := c.Tree
-
-		for _, p := range path {
-			t, err := r.GetTree(tID)
-			if err != nil {
-				return nil, fmt.Errorf("error reading tree: %w", err)
-			}
-
-			nID, ok := t[p]
-			if !ok {
-				return last, nil
-			}
-
-			tID = nID
-		}
-
-		if tID != objID {
-			return last, nil
-		}
-
-		cid = c.Parent
-		last = c
-	}
-
-	return last, nil
 }
 
 type files []string
@@ -154,30 +106,35 @@ func sortedFiles(t Tree) files {
 }
 
 type Dir struct {
-	ID    string
-	Path  []string
-	Dirs  map[string]*Dir
-	Files map[string]*File
+	ID        string
+	Path      []string
+	Dirs      map[string]*Dir
+	Files     map[string]*File
+	Commit    *Commit
+	FileCount int
+	Size      int64
 }
 
 type File struct {
-	Repo, Name, Path, Link, Ext string
-	Commit                      *Commit
-	Size                        int64
-}
-
-type Discard struct {
-	io.Writer
+	ID, Repo, Name, Path, Link, Ext, History string
+	RawPath, PrettyPath                      string
+	Commit                                   *Commit
+	Size                                     int64
+	Blame                                    []BlameLine
 }
 
-func (Discard) Close() error {
-	return nil
+type treeBuilder struct {
+	repo      string
+	r         *Repo
+	base      string
+	histories map[string][]HistoryEntry
+	rendered  map[string]struct{}
+	sizes     map[string]int64
+	keys      map[string]struct{}
 }
 
-var discard = Discard{Writer: io.Discard}
-
-func parseTree(repo string, r *Repo, tree Tree, p []string) (*Dir, error) {
-	basepath := filepath.Join(append(append(make([]string, len(p)+3), config.OutputDir, repo, "files"), p...)...)
+func (t *treeBuilder) parseTree(id string, tree Tree, last *lastCommit, p []string) (*Dir, error) {
+	basepath := filepath.Join(append(append(make([]string, len(p)+2), t.base, "files"), p...)...)
 
 	if err := os.MkdirAll(basepath, 0o755); err != nil {
 		return nil, fmt.Errorf("error creating directories: %w", err)
@@ -194,49 +151,71 @@ func parseTree(repo string, r *Repo, tree Tree, p []string) (*Dir, error) {
 		fileMap[file.Name()] = struct{}{}
 	}
 
+	var rawpath string
+
+	rawMap := make(map[string]struct{})
+
+	if config.RawDir != "" {
+		rawpath = filepath.Join(append(append(make([]string, len(p)+2), t.base, config.RawDir), p...)...)
+
+		files, err := os.ReadDir(rawpath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading raw file directory: %w", err)
+		}
+
+		for _, file := range files {
+			rawMap[file.Name()] = struct{}{}
+		}
+	}
+
 	dir := &Dir{
-		Dirs:  make(map[string]*Dir),
-		Files: make(map[string]*File),
-		Path:  append(make([]string, 0, len(p)), p...),
+		ID:     id,
+		Dirs:   make(map[string]*Dir),
+		Files:  make(map[string]*File),
+		Path:   append(make([]string, 0, len(p)), p...),
+		Commit: last.commit,
 	}
 
 	for _, f := range sortedFiles(tree) {
 		if f[len(f)-1] == '/' {
-			nt, err := r.GetTree(tree[f])
+			nt, err := t.r.GetTree(tree[f])
 			if err != nil {
 				return nil, fmt.Errorf("error reading tree: %w", err)
 			}
 
-			d, err := parseTree(repo, r, nt, append(p, f))
+			d, err := t.parseTree(tree[f], nt, last.children[f], append(p, f))
 			if err != nil {
 				return nil, fmt.Errorf("error parsing dir: %w", err)
 			}
 
-			d.ID = tree[f]
 			dir.Dirs[f[:len(f)-1]] = d
+			dir.FileCount += d.FileCount
+			dir.Size += d.Size
 
 			delete(fileMap, f[:len(f)-1])
+			delete(rawMap, f[:len(f)-1])
 		} else {
 			fpath := append(p, f)
-
-			c, err := getFileLastCommit(r, fpath)
-			if err != nil {
-				return nil, fmt.Errorf("error reading files last commit: %w", err)
-			}
+			c := last.children[f].commit
 
 			name := f
 			file := &File{
-				Repo:   repo,
+				ID:     tree[f],
+				Repo:   t.repo,
 				Name:   name,
 				Path:   path.Join(fpath...),
 				Ext:    filepath.Ext(name),
 				Commit: c,
 			}
 
+			if config.HistoryTemplate != "" && t.histories != nil {
+				file.History = historyPath(file.Path)
+			}
+
 			if f[0] == '/' {
 				name = f[1:]
 
-				b, err := r.GetBlob(tree[f])
+				b, err := t.r.GetBlob(tree[f])
 				if err != nil {
 					return nil, fmt.Errorf("error getting symlink data: %w", err)
 				}
@@ -250,81 +229,132 @@ func parseTree(repo string, r *Repo, tree Tree, p []string) (*Dir, error) {
 				b.Close()
 
 				file.Link = string(d)
+				file.Size = int64(len(d))
 			} else {
-				var o io.WriteCloser
-
-				output := true
 				outpath := filepath.Join(basepath, name)
+				file.RawPath = path.Join("files", file.Path)
+				printer, pretty := config.prettyMap[file.Ext]
 
-				b, err := r.GetBlob(tree[f])
-				if err != nil {
-					return nil, fmt.Errorf("error getting file data: %w", err)
-				}
-
-				if _, ok := fileMap[name]; !force && ok {
-					fi, err := os.Stat(outpath)
-					if err != nil {
-						return nil, fmt.Errorf("error while stat'ing file: %w", err)
-					}
+				if pretty {
+					file.PrettyPath = file.RawPath
+					file.RawPath = ""
 
-					if fi.ModTime().Equal(c.Time) {
-						output = false
-						o = discard
-					}
-				}
+					if config.RawDir != "" {
+						file.RawPath = path.Join(config.RawDir, file.Path)
 
-				var printer parser.TokenFunc
+						if err := t.writeRaw(tree[f], filepath.Join(rawpath, name), c.Time); err != nil {
+							return nil, err
+						}
 
-				if output {
-					o, err = os.Create(outpath)
-					if err != nil {
-						return nil, fmt.Errorf("error creating data file: %w", err)
-					}
-
-					if p, ok := config.prettyMap[file.Ext]; ok {
-						printer = p
+						delete(rawMap, name)
 					}
 				}
 
-				if file.Size, err = prettify(file, o, b, printer); err != nil {
-					o.Close()
-
-					return nil, fmt.Errorf("error writing file data: %w", err)
-				}
-
-				if err := o.Close(); err != nil {
-					return nil, fmt.Errorf("error closing file: %w", err)
-				}
-
-				if output {
-					if err := os.Chtimes(outpath, c.Time, c.Time); err != nil {
-						return nil, fmt.Errorf("error setting file time: %w", err)
-					}
+				if err := t.writeFile(file, tree[f], outpath, printer); err != nil {
+					return nil, err
 				}
 
 				delete(fileMap, name)
 			}
 
 			dir.Files[name] = file
+			dir.FileCount++
+			dir.Size += file.Size
 		}
 	}
 
+	if _, ok := dir.Files[config.DirIndexFile]; config.DirTemplate != "" && !ok { // a file of the same name takes precedence
+		if err := buildDirIndex(t.repo, dir, filepath.Join(basepath, config.DirIndexFile)); err != nil {
+			return nil, err
+		}
+
+		delete(fileMap, config.DirIndexFile)
+	}
+
 	for f := range fileMap {
-		if err := os.Remove(filepath.Join(basepath, f)); err != nil {
+		if err := os.RemoveAll(filepath.Join(basepath, f)); err != nil {
 			return nil, fmt.Errorf("error removing file: %w", err)
 		}
 	}
 
+	for f := range rawMap {
+		if err := os.RemoveAll(filepath.Join(rawpath, f)); err != nil {
+			return nil, fmt.Errorf("error removing raw file: %w", err)
+		}
+	}
+
 	return dir, nil
 }
 
+type DirInfo struct {
+	Repo string
+	*Dir
+}
+
+func buildDirIndex(repo string, dir *Dir, outpath string) error {
+	if !force {
+		fi, err := os.Stat(outpath)
+		if err == nil && fi.ModTime().Equal(dir.Commit.Time) {
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error stat'ing directory index: %w", err)
+		}
+	}
+
+	f, err := createOutput(outpath)
+	if err != nil {
+		return fmt.Errorf("error creating directory index: %w", err)
+	}
+
+	if err := config.dirTemplate.Execute(f, DirInfo{
+		Repo: repo,
+		Dir:  dir,
+	}); err != nil {
+		f.Close()
+
+		return fmt.Errorf("error processing directory template: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing directory index: %w", err)
+	}
+
+	if err := os.Chtimes(outpath, dir.Commit.Time, dir.Commit.Time); err != nil {
+		return fmt.Errorf("error setting directory index time: %w", err)
+	}
+
+	return nil
+}
+
 type RepoInfo struct {
 	Name, Desc string
 	Root       *Dir
+	Commit     *Commit
+	Tags       []*Tag
+	Archives   []Archive
+	Bundle     string
+}
+
+// repoPath returns the path of the git directory for the named repo, or of
+// its bundle file when there is no such directory.
+func repoPath(repo string) string {
+	if _, err := os.Stat(filepath.Join(config.ReposDir, repo)); os.IsNotExist(err) {
+		if bundle := filepath.Join(config.ReposDir, repo+".bundle"); fileExists(bundle) {
+			return bundle
+		}
+	}
+
+	return filepath.Join(config.ReposDir, repo, config.GitDir)
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+
+	return err == nil && fi.Mode().IsRegular()
 }
 
 func buildRepo(repo string) error {
-	r := OpenRepo(filepath.Join(config.ReposDir, repo, config.GitDir))
+	r := OpenRepo(repoPath(repo))
 
 	cid, err := r.GetLatestCommitID()
 	if err != nil {
@@ -336,9 +366,98 @@ func buildRepo(repo string) error {
 		return fmt.Errorf("error reading commit: %w", err)
 	}
 
+	var tags []*Tag
+
+	// tags are only read before the index check when they can change one of
+	// the outputs built regardless of it
+	if config.SnapshotTags || len(config.ArchiveFormats) > 0 || config.BaseURL != "" {
+		if tags, err = r.Tags(); err != nil {
+			return fmt.Errorf("error reading tags: %w", err)
+		}
+	}
+
+	var commits []*Commit
+
+	// likewise, the full history is only read before the index check when
+	// every commit is being snapshotted
+	if config.SnapshotCommits {
+		if commits, err = r.walkLog(cid); err != nil {
+			return fmt.Errorf("error reading snapshot commits: %w", err)
+		}
+	}
+
+	snapshots := snapshotCommits(tags, commits)
+
+	if err := removeSnapshots(repo, snapshots); err != nil {
+		return err
+	}
+
+	pending, err := pendingSnapshots(repo, snapshots)
+	if err != nil {
+		return err
+	}
+
+	archives := archiveList(repo, latest, tags)
+
+	if err := removeArchives(repo, archives); err != nil {
+		return err
+	}
+
+	staleArchives, err := pendingArchives(repo, archives)
+	if err != nil {
+		return err
+	}
+
+	if config.DumbHTTP && !r.bundle { // bundles have no object files to mirror
+		if err := buildDumbHTTP(repo, r); err != nil {
+			return fmt.Errorf("error building dumb HTTP repo: %w", err)
+		}
+	}
+
+	var (
+		bundle    string
+		newBundle bool
+	)
+
+	if config.Bundle {
+		if newBundle, err = buildBundle(repo, r); err != nil {
+			return fmt.Errorf("error building bundle: %w", err)
+		}
+
+		bundle = repo + ".bundle"
+	} else if err := os.Remove(bundlePath(repo)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing bundle: %w", err)
+	}
+
+	if config.BaseURL != "" {
+		if err := buildFeeds(repo, r, latest, tags, archives); err != nil {
+			return fmt.Errorf("error building feeds: %w", err)
+		}
+	}
+
+	var staleAPI bool
+
+	if config.JSONAPI {
+		if staleAPI, err = apiStale(repo, latest); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(apiPath(repo)); err != nil {
+		return fmt.Errorf("error removing JSON API: %w", err)
+	}
+
+	var staleSearch bool
+
+	if config.SearchIndex {
+		if staleSearch, err = searchStale(repo, latest); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(filepath.Join(config.OutputDir, repo, "search")); err != nil {
+		return fmt.Errorf("error removing search index: %w", err)
+	}
+
 	indexPath := filepath.Join(config.OutputDir, repo, "index.html")
 
-	if !force {
+	if !force && !newBundle && !staleAPI && !staleSearch && len(pending) == 0 && len(staleArchives) == 0 {
 		fi, err := os.Stat(indexPath)
 		if !os.IsNotExist(err) {
 			if err != nil {
@@ -349,26 +468,113 @@ func buildRepo(repo string) error {
 		}
 	}
 
+	if tags == nil {
+		if tags, err = r.Tags(); err != nil {
+			return fmt.Errorf("error reading tags: %w", err)
+		}
+	}
+
 	tree, err := r.GetTree(latest.Tree)
 	if err != nil {
 		return fmt.Errorf("error reading tree: %w", err)
 	}
 
-	d, err := parseTree(repo, r, tree, []string{})
+	var histories map[string][]HistoryEntry
+
+	if config.HistoryTemplate != "" || config.Blame {
+		if histories, err = r.fileHistories(cid, config.FollowRenames); err != nil {
+			return fmt.Errorf("error reading file histories: %w", err)
+		}
+	}
+
+	last, err := r.lastCommits(cid)
+	if err != nil {
+		return fmt.Errorf("error reading last commits: %w", err)
+	}
+
+	t := &treeBuilder{
+		repo:      repo,
+		r:         r,
+		base:      filepath.Join(config.OutputDir, repo),
+		histories: histories,
+		rendered:  make(map[string]struct{}),
+		sizes:     make(map[string]int64),
+		keys:      make(map[string]struct{}),
+	}
+
+	d, err := t.parseTree(latest.Tree, tree, last, []string{})
 	if err != nil {
 		return err
 	}
 
-	index, err := os.Create(indexPath)
+	if err := t.writeStoreRefs(); err != nil {
+		return err
+	}
+
+	if err := buildSnapshots(t, pending, tags); err != nil {
+		return err
+	}
+
+	if commits == nil && (config.CommitTemplate != "" || config.LogTemplate != "" || config.JSONAPI || config.SearchIndex) {
+		if commits, err = r.walkLog(cid); err != nil {
+			return err
+		}
+	}
+
+	if config.CommitTemplate != "" {
+		if err := buildCommits(repo, r, commits); err != nil {
+			return err
+		}
+	}
+
+	if config.LogTemplate != "" {
+		if err := buildLog(repo, commits); err != nil {
+			return err
+		}
+	}
+
+	if config.HistoryTemplate != "" {
+		if err := buildHistories(repo, histories); err != nil {
+			return err
+		}
+	}
+
+	if err := buildArchives(repo, r, staleArchives); err != nil {
+		return err
+	}
+
+	info := RepoInfo{
+		Name:     repo,
+		Desc:     r.GetDescription(),
+		Root:     d,
+		Commit:   latest,
+		Tags:     tags,
+		Archives: archives,
+		Bundle:   bundle,
+	}
+
+	if config.SearchIndex {
+		if err := buildSearchIndex(repo, r, d, latest, commits); err != nil {
+			return fmt.Errorf("error building search index: %w", err)
+		}
+	}
+
+	if config.JSONAPI {
+		if err := buildAPI(repo, r, info, commits); err != nil {
+			return fmt.Errorf("error building JSON API: %w", err)
+		}
+	}
+
+	return writeRepoIndex(indexPath, info)
+}
+
+func writeRepoIndex(indexPath string, info RepoInfo) error {
+	index, err := createOutput(indexPath)
 	if err != nil {
 		return fmt.Errorf("error creating repo index: %w", err)
 	}
 
-	if err := config.repoTemplate.Execute(index, RepoInfo{
-		Name: repo,
-		Desc: r.GetDescription(),
-		Root: d,
-	}); err != nil {
+	if err := config.repoTemplate.Execute(index, info); err != nil {
 		index.Close()
 
 		return fmt.Errorf("error processing repo template: %w", err)
@@ -378,7 +584,7 @@ func buildRepo(repo string) error {
 		return fmt.Errorf("error closing index: %w", err)
 	}
 
-	if err := os.Chtimes(indexPath, latest.Time, latest.Time); err != nil {
+	if err := os.Chtimes(indexPath, info.Commit.Time, info.Commit.Time); err != nil {
 		return fmt.Errorf("error setting repo index file time: %w", err)
 	}
 
@@ -399,43 +605,66 @@ func buildIndex() error {
 
 	repos := make([]RepoData, 0, len(dir))
 
-	var latest time.Time
+	var (
+		latest time.Time
+		recent []repoCommit
+	)
 
 	for _, r := range dir {
-		if r.Type()&fs.ModeDir != 0 {
-			var c *Commit
+		name := r.Name()
 
-			name := r.Name()
-			rp := OpenRepo(filepath.Join(config.ReposDir, name, config.GitDir))
+		if r.Type().IsRegular() && strings.HasSuffix(name, ".bundle") {
+			name = strings.TrimSuffix(name, ".bundle")
 
-			cid, err := rp.GetLatestCommitID()
-			if err == nil {
-				c, err = rp.GetCommit(cid)
+			if _, err := os.Stat(filepath.Join(config.ReposDir, name)); !os.IsNotExist(err) {
+				continue
 			}
+		} else if r.Type()&fs.ModeDir == 0 {
+			continue
+		}
 
-			if err == nil {
-				pinPos := -1
+		var c *Commit
 
-				for n, m := range config.Pinned {
-					if m == name {
-						pinPos = n
+		rp := OpenRepo(repoPath(name))
 
-						break
-					}
-				}
+		cid, err := rp.GetLatestCommitID()
+		if err == nil {
+			c, err = rp.GetCommit(cid)
+		}
 
-				if c.Time.After(latest) {
-					latest = c.Time
+		if err == nil {
+			pinPos := -1
+
+			for n, m := range config.Pinned {
+				if m == name {
+					pinPos = n
+
+					break
 				}
+			}
 
-				repos = append(repos, RepoData{
-					Name:           name,
-					Desc:           rp.GetDescription(),
-					LastCommit:     c.Msg,
-					LastCommitTime: c.Time,
-					Pin:            pinPos,
-				})
+			if c.Time.After(latest) {
+				latest = c.Time
+			}
+
+			if config.BaseURL != "" {
+				// as with a repo whose latest commit can't be read, a
+				// repo whose history can't be read is left out of the
+				// feed rather than failing the whole index
+				if commits, err := rp.walkLogLimit(cid, config.FeedSize); err == nil {
+					for _, c := range commits {
+						recent = append(recent, repoCommit{repo: name, commit: c})
+					}
+				}
 			}
+
+			repos = append(repos, RepoData{
+				Name:           name,
+				Desc:           rp.GetDescription(),
+				LastCommit:     c.Msg,
+				LastCommitTime: c.Time,
+				Pin:            pinPos,
+			})
 		}
 	}
 
@@ -443,19 +672,6 @@ func buildIndex() error {
 		return errors.New("no repos")
 	}
 
-	indexPath := filepath.Join(config.OutputDir, config.IndexFile)
-
-	if !force {
-		fi, err := os.Stat(indexPath)
-		if !os.IsNotExist(err) {
-			if err != nil {
-				return fmt.Errorf("error stat'ing main index file: %w", err)
-			} else if fi.ModTime().Equal(latest) {
-				return nil
-			}
-		}
-	}
-
 	sort.Slice(repos, func(i, j int) bool {
 		ir := repos[i]
 		jr := repos[j]
@@ -471,6 +687,37 @@ func buildIndex() error {
 		return ir.Pin < jr.Pin
 	})
 
+	if config.JSONAPI {
+		if err := buildAPIRepoList(repos); err != nil {
+			return fmt.Errorf("error building JSON API repo list: %w", err)
+		}
+	} else if err := os.RemoveAll(apiPath()); err != nil {
+		return fmt.Errorf("error removing JSON API: %w", err)
+	}
+
+	if err := buildSearchScript(); err != nil {
+		return err
+	}
+
+	if config.BaseURL != "" {
+		if err := buildSiteFeed(recent); err != nil {
+			return fmt.Errorf("error building site feed: %w", err)
+		}
+	}
+
+	indexPath := filepath.Join(config.OutputDir, config.IndexFile)
+
+	if !force {
+		fi, err := os.Stat(indexPath)
+		if !os.IsNotExist(err) {
+			if err != nil {
+				return fmt.Errorf("error stat'ing main index file: %w", err)
+			} else if fi.ModTime().Equal(latest) {
+				return nil
+			}
+		}
+	}
+
 	f, err := os.Create(indexPath)
 	if err != nil {
 		return fmt.Errorf("error creating index: %w", err)
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"vimagination.zapto.org/parser"
+)
+
+func testTreeBuilder(r *Repo, repo string) *treeBuilder {
+	return &treeBuilder{
+		repo:     repo,
+		r:        r,
+		base:     filepath.Join(config.OutputDir, repo),
+		rendered: make(map[string]struct{}),
+		sizes:    make(map[string]int64),
+		keys:     make(map[string]struct{}),
+	}
+}
+
+// parseCommit parses the tree of the given commit into the output directory.
+func parseCommit(t *testing.T, b *treeBuilder, id string) *Dir {
+	t.Helper()
+
+	last, err := b.r.lastCommits(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err := b.r.GetCommit(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tree, err := b.r.GetTree(c.Tree)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	d, err := b.parseTree(c.Tree, tree, last, []string{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return d
+}
+
+type dirSummary struct {
+	Commit    string
+	FileCount int
+	Size      int64
+	Files     map[string]string
+}
+
+// summariseDirs describes each directory by path, with the root being the
+// empty path.
+func summariseDirs(d *Dir, p string, dirs map[string]dirSummary) map[string]dirSummary {
+	files := make(map[string]string, len(d.Files))
+
+	for name, f := range d.Files {
+		files[name] = f.Commit.Msg
+	}
+
+	dirs[p] = dirSummary{Commit: d.Commit.Msg, FileCount: d.FileCount, Size: d.Size, Files: files}
+
+	for name, sub := range d.Dirs {
+		summariseDirs(sub, p+name+"/", dirs)
+	}
+
+	return dirs
+}
+
+func TestParseTreeDirs(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	r := OpenRepo(gitDir)
+
+	for n, test := range [...]struct {
+		Head     string
+		Expected map[string]dirSummary
+	}{
+		{ // 1
+			Head: ids["c1"],
+			Expected: map[string]dirSummary{
+				"":     {Commit: "c1", FileCount: 3, Size: 10, Files: map[string]string{"a.txt": "c1", "b.txt": "c1"}},
+				"dir/": {Commit: "c1", FileCount: 1, Size: 2, Files: map[string]string{"c.txt": "c1"}},
+			},
+		},
+		{ // 2
+			Head: ids["c5"],
+			Expected: map[string]dirSummary{
+				"":     {Commit: "c5", FileCount: 2, Size: 10, Files: map[string]string{"a.txt": "c4"}},
+				"dir/": {Commit: "c5", FileCount: 1, Size: 2, Files: map[string]string{"moved.txt": "c5"}},
+			},
+		},
+		{ // 3
+			Head: ids["c7"],
+			Expected: map[string]dirSummary{
+				"":     {Commit: "c7", FileCount: 3, Size: 21, Files: map[string]string{"a.txt": "c4"}},
+				"dir/": {Commit: "c7", FileCount: 2, Size: 13, Files: map[string]string{"c.txt": "c6", "moved.txt": "c7"}},
+			},
+		},
+	} {
+		config.OutputDir = t.TempDir()
+
+		d := parseCommit(t, testTreeBuilder(r, "repo"), test.Head)
+
+		if got := summariseDirs(d, "", map[string]dirSummary{}); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("test %d: expecting dirs %v, got %v", n+1, test.Expected, got)
+		}
+	}
+}
+
+func TestBuildDirIndex(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.DirTemplate = "dir"
+	config.dirTemplate = template.Must(template.New("dir").Parse("{{.Repo}} /{{range .Path}}{{.}}{{end}} {{.Commit.Msg}} {{.FileCount}} {{.Size}}"))
+	r := OpenRepo(gitDir)
+
+	for n, test := range [...]struct {
+		IndexFile      string
+		Indexes, Files map[string]string
+	}{
+		{ // 1
+			IndexFile: "index.html",
+			Indexes: map[string]string{
+				"index.html":     "repo / c7 3 21",
+				"dir/index.html": "repo /dir/ c7 2 13",
+			},
+		},
+		{ // 2
+			IndexFile: "c.txt",
+			Indexes: map[string]string{
+				"c.txt": "repo / c7 3 21",
+			},
+			Files: map[string]string{
+				"dir/c.txt": "new c\n",
+			},
+		},
+	} {
+		config.OutputDir = t.TempDir()
+		config.DirIndexFile = test.IndexFile
+		base := filepath.Join(config.OutputDir, "repo", "files")
+
+		writeFiles(t, base, map[string]string{"old/" + test.IndexFile: "old"})
+
+		d := parseCommit(t, testTreeBuilder(r, "repo"), ids["c7"])
+
+		for p, expected := range test.Indexes {
+			path := filepath.Join(base, filepath.FromSlash(p))
+
+			if data, err := os.ReadFile(path); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(data) != expected {
+				t.Errorf("test %d: expecting %s to be %q, got %q", n+1, p, expected, data)
+			} else if fi, _ := os.Stat(path); !fi.ModTime().Equal(d.Commit.Time) {
+				t.Errorf("test %d: expecting %s to have the time %s, got %s", n+1, p, d.Commit.Time, fi.ModTime())
+			}
+		}
+
+		for p, expected := range test.Files {
+			if data, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(p))); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(data) != expected {
+				t.Errorf("test %d: expecting file %s to take precedence over the index, got %q", n+1, p, data)
+			}
+		}
+
+		if fileExists(filepath.Join(base, "old")) {
+			t.Errorf("test %d: expecting directory no longer in the tree to be removed", n+1)
+		}
+	}
+
+	// an index with the time of its directory's commit is assumed to be up-to-date
+	path := filepath.Join(config.OutputDir, "index.html")
+	d := &Dir{Commit: &Commit{Msg: "c8", Time: time.Date(2021, 1, 1, 8, 0, 0, 0, time.UTC)}}
+
+	if err := buildDirIndex("repo", d, path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := buildDirIndex("other", d, path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != "repo / c8 0 0" {
+		t.Errorf("expecting up-to-date index to be kept, got %q", data)
+	}
+
+	// an index replacing a file from the store must not overwrite the stored file
+	stored := filepath.Join(config.OutputDir, "stored")
+
+	writeFiles(t, config.OutputDir, map[string]string{"stored": "stored"})
+	os.Remove(path)
+
+	if err := os.Link(stored, path); err != nil {
+		t.Skipf("unable to link files: %s", err)
+	}
+
+	if err := buildDirIndex("repo", d, path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if data, _ := os.ReadFile(path); string(data) != "repo / c8 0 0" {
+		t.Errorf("expecting index to replace linked file, got %q", data)
+	}
+
+	if data, _ := os.ReadFile(stored); string(data) != "stored" {
+		t.Errorf("expecting stored file to be unchanged, got %q", data)
+	}
+}
+
+func TestParseTreeRaw(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.prettyTemplate = template.Must(template.New("pretty").Parse("{{.Name}} {{.RawPath}} {{.PrettyPath}}:{{range .Tokens}}{{.Data}}{{end}}"))
+	r := OpenRepo(gitDir)
+
+	for n, test := range [...]struct {
+		RawDir, Ext string
+		RawPath     string
+		PrettyPath  string
+		Files       map[string]string
+	}{
+		{ // 1
+			RawDir:  "raw",
+			RawPath: "files/dir/moved.txt",
+			Files: map[string]string{
+				"files/a.txt":         "1\nX\n3\n4\n",
+				"files/dir/moved.txt": "b\nmore\n",
+			},
+		},
+		{ // 2
+			RawDir:     "raw",
+			Ext:        ".txt",
+			RawPath:    "raw/dir/moved.txt",
+			PrettyPath: "files/dir/moved.txt",
+			Files: map[string]string{
+				"files/a.txt":         "a.txt raw/a.txt files/a.txt:1\nX\n3\n4\n",
+				"files/dir/moved.txt": "moved.txt raw/dir/moved.txt files/dir/moved.txt:b\nmore\n",
+				"raw/a.txt":           "1\nX\n3\n4\n",
+				"raw/dir/moved.txt":   "b\nmore\n",
+			},
+		},
+		{ // 3
+			Ext:        ".txt",
+			PrettyPath: "files/dir/moved.txt",
+			Files: map[string]string{
+				"files/a.txt":         "a.txt  files/a.txt:1\nX\n3\n4\n",
+				"files/dir/moved.txt": "moved.txt  files/dir/moved.txt:b\nmore\n",
+			},
+		},
+	} {
+		config.OutputDir = t.TempDir()
+		config.RawDir = test.RawDir
+		config.prettyMap = map[string]parser.TokenFunc{}
+		base := filepath.Join(config.OutputDir, "repo")
+
+		if test.Ext != "" {
+			config.prettyMap[test.Ext] = prettyPrinters[".go"]
+		}
+
+		writeFiles(t, base, map[string]string{"raw/old.txt": "old", "raw/dir/old.txt": "old"})
+
+		d := parseCommit(t, testTreeBuilder(r, "repo"), ids["c7"])
+
+		if f := d.Dirs["dir"].Files["moved.txt"]; f.RawPath != test.RawPath || f.PrettyPath != test.PrettyPath {
+			t.Errorf("test %d: expecting raw path %q and pretty path %q, got %q and %q", n+1, test.RawPath, test.PrettyPath, f.RawPath, f.PrettyPath)
+		}
+
+		for p, expected := range test.Files {
+			if data, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(p))); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(data) != expected {
+				t.Errorf("test %d: expecting %s to be %q, got %q", n+1, p, expected, data)
+			}
+		}
+
+		if old := fileExists(filepath.Join(base, "raw", "old.txt")) || fileExists(filepath.Join(base, "raw", "dir", "old.txt")); old == (test.RawDir != "") {
+			t.Errorf("test %d: expecting raw files not in the tree to be removed only when writing raw files", n+1)
+		}
+	}
+}
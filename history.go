@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type HistoryEntry struct {
+	*Commit
+	Path string
+}
+
+type FileHistory struct {
+	Repo, Path string
+	Commits    []HistoryEntry
+}
+
+// fileHistories walks the first-parent history from the given commit once,
+// collecting, for each file in its tree, the commits that changed it. When
+// follow is set, files are followed back through renames and copies.
+func (r *Repo) fileHistories(head string, follow bool) (map[string][]HistoryEntry, error) {
+	c, err := r.GetCommit(head)
+	if err != nil {
+		return nil, fmt.Errorf("error reading commit: %w", err)
+	}
+
+	files, err := r.DiffTrees("", c.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := make(map[string][]string, len(files))
+	histories := make(map[string][]HistoryEntry, len(files))
+
+	for _, f := range files {
+		tracked[f.Path] = []string{f.Path}
+	}
+
+	for c != nil && len(tracked) > 0 {
+		var (
+			parent     *Commit
+			parentTree string
+		)
+
+		if c.Parent != "" {
+			if parent, err = r.GetCommit(c.Parent); err != nil {
+				return nil, fmt.Errorf("error reading commit: %w", err)
+			}
+
+			parentTree = parent.Tree
+		}
+
+		changes, err := r.DiffTrees(parentTree, c.Tree)
+		if err != nil {
+			return nil, err
+		}
+
+		if follow && parent != nil && config.RenameThreshold > 0 {
+			if changes, err = r.DetectRenames(changes, config.RenameThreshold, config.DetectCopies); err != nil {
+				return nil, err
+			}
+		}
+
+		moved := make(map[string][]string)
+
+		for _, change := range changes {
+			heads, ok := tracked[change.Path]
+			if !ok || change.Type == ChangeDeleted {
+				continue
+			}
+
+			for _, h := range heads {
+				histories[h] = append(histories[h], HistoryEntry{
+					Commit: c,
+					Path:   change.Path,
+				})
+			}
+
+			switch change.Type {
+			case ChangeRenamed, ChangeCopied:
+				moved[change.OldPath] = append(moved[change.OldPath], heads...)
+
+				fallthrough
+			case ChangeAdded:
+				delete(tracked, change.Path)
+			}
+		}
+
+		for p, heads := range moved {
+			tracked[p] = append(tracked[p], heads...)
+		}
+
+		c = parent
+	}
+
+	return histories, nil
+}
+
+func historyPath(p string) string {
+	return "history/" + p + ".html"
+}
+
+func buildHistories(repo string, histories map[string][]HistoryEntry) error {
+	base := filepath.Join(config.OutputDir, repo)
+	written := make(map[string]struct{}, len(histories))
+
+	for p, commits := range histories {
+		outpath := filepath.Join(base, filepath.FromSlash(historyPath(p)))
+		written[outpath] = struct{}{}
+		last := commits[0].Time
+
+		if !force {
+			fi, err := os.Stat(outpath)
+			if err == nil && fi.ModTime().Equal(last) {
+				continue
+			} else if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error stat'ing history file: %w", err)
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(outpath), 0o755); err != nil {
+			return fmt.Errorf("error creating history directory: %w", err)
+		}
+
+		f, err := createOutput(outpath)
+		if err != nil {
+			return fmt.Errorf("error creating history file: %w", err)
+		}
+
+		if err := config.historyTemplate.Execute(f, FileHistory{
+			Repo:    repo,
+			Path:    p,
+			Commits: commits,
+		}); err != nil {
+			f.Close()
+
+			return fmt.Errorf("error processing history template: %w", err)
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error closing history file: %w", err)
+		}
+
+		if err := os.Chtimes(outpath, last, last); err != nil {
+			return fmt.Errorf("error setting history file time: %w", err)
+		}
+	}
+
+	return filepath.WalkDir(filepath.Join(base, "history"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		if _, ok := written[path]; !ok {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing history file: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
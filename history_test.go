@@ -0,0 +1,145 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// historyNames describes the entries of a history as message:path.
+func historyNames(history []HistoryEntry) []string {
+	names := make([]string, len(history))
+
+	for n, e := range history {
+		names[n] = e.Msg + ":" + e.Path
+	}
+
+	return names
+}
+
+func TestFileHistories(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	r := OpenRepo(gitDir)
+
+	for n, test := range [...]struct {
+		Head      string
+		Follow    bool
+		Threshold int
+		Histories map[string][]string
+	}{
+		{ // 1
+			Head: ids["c7"],
+			Histories: map[string][]string{
+				"a.txt":         {"c4:a.txt", "c2:a.txt", "c1:a.txt"},
+				"dir/c.txt":     {"c6:dir/c.txt"},
+				"dir/moved.txt": {"c7:dir/moved.txt", "c5:dir/moved.txt"},
+			},
+		},
+		{ // 2
+			Head:      ids["c7"],
+			Follow:    true,
+			Threshold: 50,
+			Histories: map[string][]string{
+				"a.txt":         {"c4:a.txt", "c2:a.txt", "c1:a.txt"},
+				"dir/c.txt":     {"c6:dir/c.txt"},
+				"dir/moved.txt": {"c7:dir/moved.txt", "c5:dir/moved.txt", "c1:b.txt"},
+			},
+		},
+		{ // 3
+			Head:   ids["c7"],
+			Follow: true,
+			Histories: map[string][]string{
+				"a.txt":         {"c4:a.txt", "c2:a.txt", "c1:a.txt"},
+				"dir/c.txt":     {"c6:dir/c.txt"},
+				"dir/moved.txt": {"c7:dir/moved.txt", "c5:dir/moved.txt"},
+			},
+		},
+		{ // 4
+			Head:      ids["c3"],
+			Follow:    true,
+			Threshold: 50,
+			Histories: map[string][]string{
+				"a.txt":         {"c2:a.txt", "c1:a.txt"},
+				"dir/c.txt":     {"c1:dir/c.txt"},
+				"dir/moved.txt": {"c3:dir/moved.txt", "c1:b.txt"},
+			},
+		},
+		{ // 5
+			Head: ids["c4"],
+			Histories: map[string][]string{
+				"a.txt": {"c4:a.txt", "c2:a.txt", "c1:a.txt"},
+				"b.txt": {"c1:b.txt"},
+			},
+		},
+	} {
+		config.RenameThreshold = test.Threshold
+
+		histories, err := r.fileHistories(test.Head, test.Follow)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		got := make(map[string][]string, len(histories))
+
+		for p, history := range histories {
+			got[p] = historyNames(history)
+		}
+
+		if !reflect.DeepEqual(got, test.Histories) {
+			t.Errorf("test %d: expecting histories %v, got %v", n+1, test.Histories, got)
+		}
+	}
+}
+
+func TestBuildHistories(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	config.historyTemplate = template.Must(template.New("history").Parse("{{.Path}}{{range .Commits}} {{.Subject}}{{end}}"))
+
+	histories, err := OpenRepo(gitDir).fileHistories(ids["c7"], false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	base := filepath.Join(config.OutputDir, "repo")
+
+	writeFiles(t, base, map[string]string{historyPath("b.txt"): "old"})
+
+	if err := buildHistories("repo", histories); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for p, expected := range map[string]string{
+		"a.txt":         "a.txt c4 c2 c1",
+		"dir/c.txt":     "dir/c.txt c6",
+		"dir/moved.txt": "dir/moved.txt c7 c5",
+	} {
+		path := filepath.Join(base, filepath.FromSlash(historyPath(p)))
+
+		if data, err := os.ReadFile(path); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if string(data) != expected {
+			t.Errorf("expecting history of %s to be %q, got %q", p, expected, data)
+		}
+
+		if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(histories[p][0].Time) {
+			t.Errorf("expecting history of %s to have the time %s, got %s", p, histories[p][0].Time, fi.ModTime())
+		}
+	}
+
+	if fileExists(filepath.Join(base, filepath.FromSlash(historyPath("b.txt")))) {
+		t.Error("expecting history of removed file to be removed")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+)
+
+type lastCommit struct {
+	commit   *Commit
+	children map[string]*lastCommit
+	pending  int
+}
+
+func (r *Repo) newLastCommit(t Tree) (*lastCommit, error) {
+	l := &lastCommit{
+		children: make(map[string]*lastCommit, len(t)),
+		pending:  1,
+	}
+
+	for name, id := range t {
+		child := &lastCommit{pending: 1}
+
+		if name[len(name)-1] == '/' {
+			ct, err := r.GetTree(id)
+			if err != nil {
+				return nil, fmt.Errorf("error reading tree: %w", err)
+			}
+
+			if child, err = r.newLastCommit(ct); err != nil {
+				return nil, err
+			}
+		}
+
+		l.children[name] = child
+		l.pending += child.pending
+	}
+
+	return l, nil
+}
+
+// lastCommits walks the first-parent history from the given commit once,
+// determining the last commit to modify each path in its tree, including
+// directories, by comparing the tree IDs of each commit with its parent.
+func (r *Repo) lastCommits(head string) (*lastCommit, error) {
+	c, err := r.GetCommit(head)
+	if err != nil {
+		return nil, fmt.Errorf("error reading commit: %w", err)
+	}
+
+	t, err := r.GetTree(c.Tree)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tree: %w", err)
+	}
+
+	root, err := r.newLastCommit(t)
+	if err != nil {
+		return nil, err
+	}
+
+	for c != nil && root.pending > 0 {
+		var (
+			parent     *Commit
+			parentTree string
+		)
+
+		if c.Parent != "" {
+			if parent, err = r.GetCommit(c.Parent); err != nil {
+				return nil, fmt.Errorf("error reading commit: %w", err)
+			}
+
+			parentTree = parent.Tree
+		}
+
+		if err := r.assignLastCommit(root, c, c.Tree, parentTree); err != nil {
+			return nil, err
+		}
+
+		c = parent
+	}
+
+	return root, nil
+}
+
+func (r *Repo) assignLastCommit(l *lastCommit, c *Commit, id, parentID string) error {
+	if id == parentID || id == "" {
+		return nil
+	}
+
+	if l.commit == nil {
+		l.commit = c
+		l.pending--
+	}
+
+	if l.children == nil || l.pending == 0 {
+		return nil
+	}
+
+	t, err := r.GetTree(id)
+	if err != nil {
+		return fmt.Errorf("error reading tree: %w", err)
+	}
+
+	var pt Tree
+
+	if parentID != "" {
+		if pt, err = r.GetTree(parentID); err != nil {
+			return fmt.Errorf("error reading tree: %w", err)
+		}
+	}
+
+	l.pending = 0
+
+	for name, child := range l.children {
+		if child.pending > 0 {
+			if err := r.assignLastCommit(child, c, t[name], pt[name]); err != nil {
+				return err
+			}
+		}
+
+		l.pending += child.pending
+	}
+
+	return nil
+}
+
+// lastCommitsFrom determines the last commit to modify each path in the tree
+// of the given commit by building up from the results of its first-parent
+// ancestors, which are stored in memo. Unchanged subtrees are shared with the
+// parent, so the cost of each additional commit is proportional to what it
+// changed.
+func (r *Repo) lastCommitsFrom(c *Commit, memo map[string]*lastCommit) (*lastCommit, error) {
+	var (
+		chain      []*Commit
+		parent     *lastCommit
+		parentTree string
+	)
+
+	for {
+		if l, ok := memo[c.ID]; ok {
+			parent = l
+			parentTree = c.Tree
+
+			break
+		}
+
+		chain = append(chain, c)
+
+		if c.Parent == "" {
+			break
+		}
+
+		p, err := r.GetCommit(c.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("error reading commit: %w", err)
+		}
+
+		c = p
+	}
+
+	for n := len(chain) - 1; n >= 0; n-- {
+		c := chain[n]
+
+		l, err := r.deriveLastCommit(c, c.Tree, parentTree, parent, true)
+		if err != nil {
+			return nil, err
+		}
+
+		memo[c.ID] = l
+		parent = l
+		parentTree = c.Tree
+	}
+
+	return parent, nil
+}
+
+func (r *Repo) deriveLastCommit(c *Commit, id, parentID string, parent *lastCommit, dir bool) (*lastCommit, error) {
+	if parent != nil && id == parentID {
+		return parent, nil
+	}
+
+	l := &lastCommit{commit: c}
+
+	if !dir {
+		return l, nil
+	}
+
+	t, err := r.GetTree(id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tree: %w", err)
+	}
+
+	var pt Tree
+
+	if parent != nil && parent.children != nil && parentID != "" {
+		if pt, err = r.GetTree(parentID); err != nil {
+			return nil, fmt.Errorf("error reading tree: %w", err)
+		}
+	} else {
+		parent = nil
+	}
+
+	l.children = make(map[string]*lastCommit, len(t))
+
+	for name, cid := range t {
+		var pc *lastCommit
+
+		if parent != nil {
+			pc = parent.children[name]
+		}
+
+		if l.children[name], err = r.deriveLastCommit(c, cid, pt[name], pc, name[len(name)-1] == '/'); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
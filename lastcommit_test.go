@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// lastCommitNames describes the last commits of a tree by path, with the
+// root being the empty path and directories having a trailing slash.
+func lastCommitNames(l *lastCommit, p string, names map[string]string) map[string]string {
+	if l.commit != nil {
+		names[p] = l.commit.Msg
+	}
+
+	for name, child := range l.children {
+		lastCommitNames(child, p+name, names)
+	}
+
+	return names
+}
+
+func TestLastCommits(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	r := OpenRepo(gitDir)
+	memo := make(map[string]*lastCommit)
+
+	for n, test := range [...]struct {
+		Head     string
+		Expected map[string]string
+	}{
+		{ // 1
+			Head: ids["c1"],
+			Expected: map[string]string{
+				"":          "c1",
+				"a.txt":     "c1",
+				"b.txt":     "c1",
+				"dir/":      "c1",
+				"dir/c.txt": "c1",
+			},
+		},
+		{ // 2
+			Head: ids["c4"],
+			Expected: map[string]string{
+				"":      "c4",
+				"a.txt": "c4",
+				"b.txt": "c1",
+			},
+		},
+		{ // 3
+			Head: ids["c5"],
+			Expected: map[string]string{
+				"":              "c5",
+				"a.txt":         "c4",
+				"dir/":          "c5",
+				"dir/moved.txt": "c5",
+			},
+		},
+		{ // 4
+			Head: ids["c7"],
+			Expected: map[string]string{
+				"":              "c7",
+				"a.txt":         "c4",
+				"dir/":          "c7",
+				"dir/c.txt":     "c6",
+				"dir/moved.txt": "c7",
+			},
+		},
+		{ // 5
+			Head: ids["c3"],
+			Expected: map[string]string{
+				"":              "c3",
+				"a.txt":         "c2",
+				"dir/":          "c3",
+				"dir/c.txt":     "c1",
+				"dir/moved.txt": "c3",
+			},
+		},
+	} {
+		l, err := r.lastCommits(test.Head)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if got := lastCommitNames(l, "", map[string]string{}); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("test %d: expecting last commits %v, got %v", n+1, test.Expected, got)
+		}
+
+		c, err := r.GetCommit(test.Head)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		if l, err = r.lastCommitsFrom(c, memo); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if got := lastCommitNames(l, "", map[string]string{}); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("test %d: expecting last commits from memo %v, got %v", n+1, test.Expected, got)
+		}
+	}
+
+	if _, ok := memo[ids["c6"]]; !ok {
+		t.Error("expecting intermediate commit to be memoised")
+	}
+}
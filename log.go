@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type commitQueue []*Commit
+
+func (c commitQueue) Len() int {
+	return len(c)
+}
+
+func (c commitQueue) Less(i, j int) bool {
+	return c[i].Time.After(c[j].Time)
+}
+
+func (c commitQueue) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+func (c *commitQueue) Push(x interface{}) {
+	*c = append(*c, x.(*Commit))
+}
+
+func (c *commitQueue) Pop() interface{} {
+	old := *c
+	x := old[len(old)-1]
+	*c = old[:len(old)-1]
+
+	return x
+}
+
+// walkLog returns all of the commits reachable from the given commit, newest
+// first, in the same order as a plain git log.
+func (r *Repo) walkLog(head string) ([]*Commit, error) {
+	return r.walkLogLimit(head, 0)
+}
+
+// walkLogLimit is like walkLog, but stops after limit commits when limit is
+// positive.
+func (r *Repo) walkLogLimit(head string, limit int) ([]*Commit, error) {
+	c, err := r.GetCommit(head)
+	if err != nil {
+		return nil, fmt.Errorf("error reading commit: %w", err)
+	}
+
+	var commits []*Commit
+
+	seen := map[string]struct{}{head: {}}
+	queue := commitQueue{c}
+
+	for len(queue) > 0 && (limit <= 0 || len(commits) < limit) {
+		c := heap.Pop(&queue).(*Commit)
+		commits = append(commits, c)
+
+		for _, p := range c.Parents {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+
+			seen[p] = struct{}{}
+
+			pc, err := r.GetCommit(p)
+			if err != nil {
+				return nil, fmt.Errorf("error reading commit: %w", err)
+			}
+
+			heap.Push(&queue, pc)
+		}
+	}
+
+	return commits, nil
+}
+
+type LogPage struct {
+	Repo        string
+	Commits     []*Commit
+	Page, Pages int
+}
+
+func buildLog(repo string, commits []*Commit) error {
+	dir := filepath.Join(config.OutputDir, repo, "log")
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating log directory: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading log directory: %w", err)
+	}
+
+	fileMap := make(map[string]struct{}, len(files))
+
+	for _, file := range files {
+		fileMap[file.Name()] = struct{}{}
+	}
+
+	pageSize := config.LogPageSize
+	if pageSize <= 0 {
+		pageSize = len(commits)
+	}
+
+	pages := (len(commits) + pageSize - 1) / pageSize
+
+	for page := 1; page <= pages; page++ {
+		start := (page - 1) * pageSize
+		end := start + pageSize
+
+		if end > len(commits) {
+			end = len(commits)
+		}
+
+		name := strconv.Itoa(page) + ".html"
+		outpath := filepath.Join(dir, name)
+
+		f, err := createOutput(outpath)
+		if err != nil {
+			return fmt.Errorf("error creating log file: %w", err)
+		}
+
+		if err := config.logTemplate.Execute(f, LogPage{
+			Repo:    repo,
+			Commits: commits[start:end],
+			Page:    page,
+			Pages:   pages,
+		}); err != nil {
+			f.Close()
+
+			return fmt.Errorf("error processing log template: %w", err)
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error closing log file: %w", err)
+		}
+
+		if err := os.Chtimes(outpath, commits[start].Time, commits[start].Time); err != nil {
+			return fmt.Errorf("error setting log file time: %w", err)
+		}
+
+		delete(fileMap, name)
+	}
+
+	for f := range fileMap {
+		if err := os.Remove(filepath.Join(dir, f)); err != nil {
+			return fmt.Errorf("error removing log file: %w", err)
+		}
+	}
+
+	return nil
+}
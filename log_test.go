@@ -0,0 +1,185 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testHistoryRepo creates a repo whose main branch has the following history,
+// each commit being an hour after the last, returning the path of its git
+// directory and the IDs of the commits by message.
+//
+//	c1 add a.txt, b.txt and dir/c.txt
+//	c2 modify a.txt
+//	c3 on a branch from c2, rename b.txt to dir/moved.txt
+//	c4 modify a.txt and delete dir/c.txt
+//	c5 merge c3 into c4
+//	c6 add dir/c.txt again
+//	c7 modify dir/moved.txt
+func testHistoryRepo(t *testing.T) (string, map[string]string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir := t.TempDir()
+	ids := make(map[string]string)
+	commit := func(msg string, args ...string) {
+		t.Helper()
+
+		when := "GIT_AUTHOR_DATE=2021-01-01T0" + msg[1:] + ":00:00Z"
+		env := []string{when, "GIT_COMMITTER" + strings.TrimPrefix(when, "GIT_AUTHOR")}
+
+		testGitEnv(t, dir, env, append(args, "-m", msg)...)
+
+		ids[msg] = testGit(t, dir, "rev-parse", "HEAD")
+	}
+
+	testGit(t, dir, "init", "-q")
+	testGit(t, dir, "symbolic-ref", "HEAD", "refs/heads/main")
+	writeFiles(t, dir, map[string]string{"a.txt": "1\n2\n3\n", "b.txt": "b\n", "dir/c.txt": "c\n"})
+	testGit(t, dir, "add", ".")
+	commit("c1", "commit", "-q")
+	writeFiles(t, dir, map[string]string{"a.txt": "1\nX\n3\n"})
+	commit("c2", "commit", "-q", "-a")
+	testGit(t, dir, "checkout", "-q", "-b", "side")
+	testGit(t, dir, "mv", "b.txt", "dir/moved.txt")
+	commit("c3", "commit", "-q")
+	testGit(t, dir, "checkout", "-q", "main")
+	writeFiles(t, dir, map[string]string{"a.txt": "1\nX\n3\n4\n"})
+	testGit(t, dir, "rm", "-q", "dir/c.txt")
+	commit("c4", "commit", "-q", "-a")
+	commit("c5", "merge", "-q", "--no-ff", "side")
+	writeFiles(t, dir, map[string]string{"dir/c.txt": "new c\n"})
+	testGit(t, dir, "add", ".")
+	commit("c6", "commit", "-q")
+	writeFiles(t, dir, map[string]string{"dir/moved.txt": "b\nmore\n"})
+	commit("c7", "commit", "-q", "-a")
+
+	return filepath.Join(dir, ".git"), ids
+}
+
+func commitIDs(commits []*Commit) []string {
+	ids := make([]string, len(commits))
+
+	for n, c := range commits {
+		ids[n] = c.ID
+	}
+
+	return ids
+}
+
+func TestWalkLog(t *testing.T) {
+	gitDir, ids := testHistoryRepo(t)
+	r := OpenRepo(gitDir)
+	all := strings.Fields(testGit(t, gitDir, "log", "--format=%H", "main"))
+
+	if len(all) != 7 {
+		t.Fatalf("expecting 7 commits from git log, got %d", len(all))
+	}
+
+	for n, test := range [...]struct {
+		Head     string
+		Limit    int
+		Expected []string
+	}{
+		{Head: ids["c7"], Expected: all},
+		{Head: ids["c7"], Limit: -1, Expected: all},
+		{Head: ids["c7"], Limit: 1, Expected: all[:1]},
+		{Head: ids["c7"], Limit: 4, Expected: all[:4]},
+		{Head: ids["c7"], Limit: 100, Expected: all},
+		{Head: ids["c5"], Expected: []string{ids["c5"], ids["c4"], ids["c3"], ids["c2"], ids["c1"]}},
+		{Head: ids["c3"], Expected: []string{ids["c3"], ids["c2"], ids["c1"]}},
+		{Head: ids["c1"], Expected: []string{ids["c1"]}},
+	} {
+		commits, err := r.walkLogLimit(test.Head, test.Limit)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if got := commitIDs(commits); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("test %d: expecting commits %v, got %v", n+1, test.Expected, got)
+		}
+	}
+
+	if _, err := r.walkLog(testID1); err == nil {
+		t.Error("expecting error walking from a missing commit, got nil")
+	}
+}
+
+func TestBuildLog(t *testing.T) {
+	gitDir, _ := testHistoryRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.logTemplate = template.Must(template.New("log").Parse("{{.Repo}} {{.Page}}/{{.Pages}}{{range .Commits}} {{.Subject}}{{end}}"))
+
+	commits, err := OpenRepo(gitDir).walkLog(testGit(t, gitDir, "rev-parse", "main"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		PageSize int
+		Pages    []string
+	}{
+		{ // 1
+			PageSize: 0,
+			Pages:    []string{"repo 1/1 c7 c6 c5 c4 c3 c2 c1"},
+		},
+		{ // 2
+			PageSize: 3,
+			Pages:    []string{"repo 1/3 c7 c6 c5", "repo 2/3 c4 c3 c2", "repo 3/3 c1"},
+		},
+		{ // 3
+			PageSize: 7,
+			Pages:    []string{"repo 1/1 c7 c6 c5 c4 c3 c2 c1"},
+		},
+		{ // 4
+			PageSize: 4,
+			Pages:    []string{"repo 1/2 c7 c6 c5 c4", "repo 2/2 c3 c2 c1"},
+		},
+	} {
+		config.OutputDir = t.TempDir()
+		config.LogPageSize = test.PageSize
+		dir := filepath.Join(config.OutputDir, "repo", "log")
+
+		writeFiles(t, dir, map[string]string{"1.html": "old", "8.html": "old"})
+
+		if err := buildLog("repo", commits); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		if files, _ := os.ReadDir(dir); len(files) != len(test.Pages) {
+			t.Errorf("test %d: expecting %d pages, got %d", n+1, len(test.Pages), len(files))
+		}
+
+		for p, expected := range test.Pages {
+			path := filepath.Join(dir, strconv.Itoa(p+1)+".html")
+
+			if data, err := os.ReadFile(path); err != nil {
+				t.Errorf("test %d: unexpected error: %s", n+1, err)
+			} else if string(data) != expected {
+				t.Errorf("test %d: expecting page %d to be %q, got %q", n+1, p+1, expected, data)
+			}
+
+			first := commits[0]
+
+			if test.PageSize > 0 {
+				first = commits[p*test.PageSize]
+			}
+
+			if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(first.Time) {
+				t.Errorf("test %d: expecting page %d to have the time %s, got %s", n+1, p+1, first.Time, fi.ModTime())
+			}
+		}
+	}
+}
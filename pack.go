@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"vimagination.zapto.org/memio"
+)
+
+const (
+	packWindow   = 10
+	packMaxDepth = 50
+	deltaBlock   = 16
+	deltaMaxCopy = 0x10000
+	deltaMult    = 16777619
+)
+
+// readRaw returns the type and contents of an object, without applying any
+// replacement refs.
+func (r *Repo) readRaw(id string) (int, []byte, error) {
+	typ, err := r.readObjectType(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	o, err := r.readObject(id, typ)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if m, ok := o.(*memio.LimitedBuffer); ok {
+		return typ, *m, nil
+	}
+
+	data, err := io.ReadAll(o)
+
+	o.Close()
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading object: %w", err)
+	}
+
+	return typ, data, nil
+}
+
+// PackObject is an object to be written to a pack. The Name, which is the
+// path of a blob or tree, is optional and is used to group similar objects
+// when looking for deltas.
+type PackObject struct {
+	ID, Name string
+}
+
+type PackEntry struct {
+	ID     string
+	Offset uint64
+	CRC    uint32
+}
+
+type Pack struct {
+	Entries  []PackEntry
+	Checksum [20]byte
+}
+
+type packEntry struct {
+	PackEntry
+	typ, depth int
+	size       int
+	hash       uint32
+	data       []byte
+	base       *packEntry
+	delta      []byte
+	index      *deltaIndex
+}
+
+func packNameHash(name string) uint32 {
+	var hash uint32
+
+	for _, c := range []byte(name) {
+		if c != ' ' && (c < '\t' || c > '\r') {
+			hash = (hash >> 2) + uint32(c)<<24
+		}
+	}
+
+	return hash
+}
+
+type countWriter struct {
+	io.Writer
+	count uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.count += uint64(n)
+
+	return n, err
+}
+
+// WritePack writes a version 2 pack containing the given objects, storing
+// objects as offset deltas of similar objects within a small window. Objects
+// are read once to order them and then again as they are written, so only
+// the objects in the window are held in memory.
+func (r *Repo) WritePack(w io.Writer, objects []PackObject) (*Pack, error) {
+	entries := make([]*packEntry, 0, len(objects))
+	seen := make(map[string]struct{}, len(objects))
+
+	for _, o := range objects {
+		if _, ok := seen[o.ID]; ok {
+			continue
+		}
+
+		seen[o.ID] = struct{}{}
+
+		typ, data, err := r.readRaw(o.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error reading object %s: %w", o.ID, err)
+		}
+
+		entries = append(entries, &packEntry{
+			PackEntry: PackEntry{ID: o.ID},
+			typ:       typ,
+			hash:      packNameHash(o.Name),
+			size:      len(data),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		} else if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+
+		return a.size > b.size
+	})
+
+	h := sha1.New()
+	cw := &countWriter{Writer: io.MultiWriter(w, h)}
+	crc := crc32.NewIEEE()
+	ew := io.MultiWriter(cw, crc)
+
+	var header [12]byte
+
+	copy(header[:], "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entries)))
+
+	if _, err := cw.Write(header[:]); err != nil {
+		return nil, fmt.Errorf("error writing pack header: %w", err)
+	}
+
+	pack := &Pack{Entries: make([]PackEntry, len(entries))}
+	z := zlib.NewWriter(nil)
+
+	for n, e := range entries {
+		typ, data, err := r.readRaw(e.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error reading object %s: %w", e.ID, err)
+		} else if typ != e.typ || len(data) != e.size {
+			return nil, fmt.Errorf("object %s changed while writing pack", e.ID)
+		}
+
+		e.data = data
+		start := 0
+
+		if n > packWindow {
+			start = n - packWindow
+			entries[start-1].data = nil
+			entries[start-1].index = nil
+		}
+
+		findDelta(entries[start:n], e)
+
+		e.Offset = cw.count
+
+		crc.Reset()
+
+		if err := writePackEntry(ew, z, e); err != nil {
+			return nil, err
+		}
+
+		e.CRC = crc.Sum32()
+		e.delta = nil
+		pack.Entries[n] = e.PackEntry
+	}
+
+	h.Sum(pack.Checksum[:0])
+
+	if _, err := w.Write(pack.Checksum[:]); err != nil {
+		return nil, fmt.Errorf("error writing pack checksum: %w", err)
+	}
+
+	return pack, nil
+}
+
+func findDelta(window []*packEntry, e *packEntry) {
+	maxSize := len(e.data)/2 - 20
+
+	for n := len(window) - 1; n >= 0; n-- {
+		base := window[n]
+
+		if base.typ != e.typ || base.depth >= packMaxDepth || len(base.data) < deltaBlock || len(e.data) < len(base.data)/32 {
+			continue
+		}
+
+		if limit := maxSize * (packMaxDepth - base.depth) / (packMaxDepth + 1); limit > 0 {
+			if base.index == nil {
+				base.index = newDeltaIndex(base.data)
+			}
+
+			if d := base.index.delta(e.data, limit); d != nil {
+				e.base = base
+				e.delta = d
+				e.depth = base.depth + 1
+				maxSize = len(d)
+			}
+		}
+	}
+}
+
+func writePackEntry(w io.Writer, z *zlib.Writer, e *packEntry) error {
+	typ, data := e.typ, e.data
+
+	if e.base != nil {
+		typ, data = ObjectOffsetDelta, e.delta
+	}
+
+	var buf [20]byte
+
+	size := uint64(len(data))
+	buf[0] = byte(typ<<4) | byte(size&15)
+	size >>= 4
+	l := 1
+
+	for size > 0 {
+		buf[l-1] |= 0x80
+		buf[l] = byte(size & 0x7f)
+		size >>= 7
+		l++
+	}
+
+	if e.base != nil {
+		offset := e.Offset - e.base.Offset
+		pos := len(buf) - 1
+		buf[pos] = byte(offset & 0x7f)
+
+		for offset >>= 7; offset > 0; offset >>= 7 {
+			offset--
+			pos--
+			buf[pos] = 0x80 | byte(offset&0x7f)
+		}
+
+		l += copy(buf[l:], buf[pos:])
+	}
+
+	if _, err := w.Write(buf[:l]); err != nil {
+		return fmt.Errorf("error writing object header: %w", err)
+	}
+
+	z.Reset(w)
+
+	if _, err := z.Write(data); err != nil {
+		return fmt.Errorf("error compressing object: %w", err)
+	}
+
+	if err := z.Close(); err != nil {
+		return fmt.Errorf("error compressing object: %w", err)
+	}
+
+	return nil
+}
+
+// WriteIndex writes a version 2 pack index for the pack.
+func (p *Pack) WriteIndex(w io.Writer) error {
+	entries := append(make([]PackEntry, 0, len(p.Entries)), p.Entries...)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	h := sha1.New()
+	bw := &packIndexWriter{w: io.MultiWriter(w, h)}
+
+	bw.write([]byte{0xff, 't', 'O', 'c'})
+	bw.uint32(2)
+
+	var fanout [256]uint32
+
+	ids := make([][20]byte, len(entries))
+
+	for n, e := range entries {
+		if _, err := hex.Decode(ids[n][:], []byte(e.ID)); err != nil {
+			return fmt.Errorf("invalid object id %s: %w", e.ID, err)
+		}
+
+		fanout[ids[n][0]]++
+	}
+
+	var total uint32
+
+	for _, count := range fanout {
+		total += count
+		bw.uint32(total)
+	}
+
+	for _, id := range ids {
+		bw.write(id[:])
+	}
+
+	for _, e := range entries {
+		bw.uint32(e.CRC)
+	}
+
+	var large []uint64
+
+	for _, e := range entries {
+		if e.Offset < 0x80000000 {
+			bw.uint32(uint32(e.Offset))
+		} else {
+			bw.uint32(0x80000000 | uint32(len(large)))
+
+			large = append(large, e.Offset)
+		}
+	}
+
+	for _, offset := range large {
+		bw.uint64(offset)
+	}
+
+	bw.write(p.Checksum[:])
+
+	if bw.err != nil {
+		return fmt.Errorf("error writing pack index: %w", bw.err)
+	}
+
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return fmt.Errorf("error writing pack index checksum: %w", err)
+	}
+
+	return nil
+}
+
+type packIndexWriter struct {
+	w   io.Writer
+	buf [8]byte
+	err error
+}
+
+func (p *packIndexWriter) write(data []byte) {
+	if p.err == nil {
+		_, p.err = p.w.Write(data)
+	}
+}
+
+func (p *packIndexWriter) uint32(n uint32) {
+	binary.BigEndian.PutUint32(p.buf[:4], n)
+	p.write(p.buf[:4])
+}
+
+func (p *packIndexWriter) uint64(n uint64) {
+	binary.BigEndian.PutUint64(p.buf[:], n)
+	p.write(p.buf[:])
+}
+
+type deltaIndex struct {
+	src    []byte
+	blocks map[uint32]int
+}
+
+func deltaHash(data []byte) uint32 {
+	var h uint32
+
+	for _, b := range data[:deltaBlock] {
+		h = h*deltaMult + uint32(b)
+	}
+
+	return h
+}
+
+func newDeltaIndex(src []byte) *deltaIndex {
+	d := &deltaIndex{
+		src:    src,
+		blocks: make(map[uint32]int, len(src)/deltaBlock),
+	}
+
+	for n := 0; n+deltaBlock <= len(src); n += deltaBlock {
+		h := deltaHash(src[n:])
+
+		if _, ok := d.blocks[h]; !ok {
+			d.blocks[h] = n
+		}
+	}
+
+	return d
+}
+
+func appendDeltaSize(buf []byte, size int) []byte {
+	for size >= 0x80 {
+		buf = append(buf, byte(size)|0x80)
+		size >>= 7
+	}
+
+	return append(buf, byte(size))
+}
+
+func appendInsert(buf, data []byte) []byte {
+	for len(data) > 0 {
+		l := len(data)
+		if l > 0x7f {
+			l = 0x7f
+		}
+
+		buf = append(append(buf, byte(l)), data[:l]...)
+		data = data[l:]
+	}
+
+	return buf
+}
+
+func appendCopy(buf []byte, offset, size int) []byte {
+	pos := len(buf)
+	op := byte(0x80)
+	buf = append(buf, 0)
+
+	for n := 0; n < 4; n++ {
+		if b := byte(offset >> (8 * n)); b != 0 {
+			op |= 1 << n
+			buf = append(buf, b)
+		}
+	}
+
+	if size != deltaMaxCopy {
+		for n := 0; n < 3; n++ {
+			if b := byte(size >> (8 * n)); b != 0 {
+				op |= 0x10 << n
+				buf = append(buf, b)
+			}
+		}
+	}
+
+	buf[pos] = op
+
+	return buf
+}
+
+// delta creates a delta that builds target from the indexed source, or nil if
+// the delta would be larger than maxSize.
+func (d *deltaIndex) delta(target []byte, maxSize int) []byte {
+	buf := appendDeltaSize(appendDeltaSize(nil, len(d.src)), len(target))
+
+	var (
+		pow    uint32 = 1
+		h      uint32
+		insert int
+	)
+
+	for n := 1; n < deltaBlock; n++ {
+		pow *= deltaMult
+	}
+
+	if len(target) >= deltaBlock {
+		h = deltaHash(target)
+	}
+
+	for n := 0; n < len(target); {
+		if n+deltaBlock <= len(target) {
+			if o, ok := d.blocks[h]; ok && bytes.Equal(d.src[o:o+deltaBlock], target[n:n+deltaBlock]) {
+				for o > 0 && n > insert && d.src[o-1] == target[n-1] {
+					o--
+					n--
+				}
+
+				l := 0
+
+				for o+l < len(d.src) && n+l < len(target) && d.src[o+l] == target[n+l] && l < deltaMaxCopy {
+					l++
+				}
+
+				buf = appendCopy(appendInsert(buf, target[insert:n]), o, l)
+
+				if len(buf) > maxSize {
+					return nil
+				}
+
+				n += l
+				insert = n
+
+				if n+deltaBlock <= len(target) {
+					h = deltaHash(target[n:])
+				}
+
+				continue
+			}
+
+			if n+deltaBlock < len(target) {
+				h = (h-uint32(target[n])*pow)*deltaMult + uint32(target[n+deltaBlock])
+			}
+		}
+
+		n++
+
+		if n-insert > maxSize {
+			return nil
+		}
+	}
+
+	buf = appendInsert(buf, target[insert:])
+
+	if len(buf) > maxSize {
+		return nil
+	}
+
+	return buf
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPackRepo writes the pack and its index into a new git directory.
+func testPackRepo(t *testing.T, data []byte, p *Pack) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	name := "pack-" + hex.EncodeToString(p.Checksum[:])
+
+	var idx bytes.Buffer
+
+	if err := p.WriteIndex(&idx); err != nil {
+		t.Fatalf("unexpected error writing index: %s", err)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"objects/info/packs":             "P " + name + ".pack\n",
+		"objects/pack/" + name + ".pack": string(data),
+		"objects/pack/" + name + ".idx":  idx.String(),
+	})
+
+	return dir
+}
+
+func TestWritePack(t *testing.T) {
+	src := t.TempDir()
+
+	var text strings.Builder
+
+	for n := 0; n < 200; n++ {
+		fmt.Fprintf(&text, "line %d of some text that is long enough to delta\n", n)
+	}
+
+	base := text.String()
+	blobs := []string{
+		testObject(t, src, ObjectBlob, base),
+		testObject(t, src, ObjectBlob, base+"one more line\n"),
+		testObject(t, src, ObjectBlob, strings.Replace(base, "line 100 ", "LINE 100 ", 1)),
+		testObject(t, src, ObjectBlob, "small\n"),
+	}
+	tree := testTree(t, src, map[string]string{"a": blobs[0], "b": blobs[1], "c": blobs[2], "d": blobs[3]})
+	commit := testObject(t, src, ObjectCommit, "tree "+tree+"\nauthor A <a@b> 1 +0000\ncommitter A <a@b> 1 +0000\n\nmsg\n")
+	objects := []PackObject{
+		{ID: commit},
+		{ID: tree},
+		{ID: blobs[0], Name: "a"},
+		{ID: blobs[1], Name: "a"},
+		{ID: blobs[2], Name: "a"},
+		{ID: blobs[3], Name: "d"},
+		{ID: blobs[0], Name: "a"},
+	}
+
+	var buf bytes.Buffer
+
+	p, err := OpenRepo(src).WritePack(&buf, objects)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(p.Entries) != len(objects)-1 {
+		t.Errorf("expecting %d entries, got %d", len(objects)-1, len(p.Entries))
+	}
+
+	var deltas int
+
+	for _, e := range p.Entries {
+		if typ := buf.Bytes()[e.Offset] >> 4 & 7; typ == ObjectOffsetDelta {
+			deltas++
+		}
+	}
+
+	if deltas != 2 {
+		t.Errorf("expecting 2 delta objects, got %d", deltas)
+	}
+
+	dir := testPackRepo(t, buf.Bytes(), p)
+	r := OpenRepo(dir)
+	sr := OpenRepo(src)
+
+	for _, o := range objects {
+		typ, data, err := r.readRaw(o.ID)
+		if err != nil {
+			t.Errorf("unexpected error reading %s from pack: %s", o.ID, err)
+
+			continue
+		}
+
+		styp, sdata, _ := sr.readRaw(o.ID)
+
+		if typ != styp || !bytes.Equal(data, sdata) {
+			t.Errorf("object %s differs after writing to pack", o.ID)
+		}
+	}
+
+	if _, err := exec.LookPath("git"); err == nil {
+		idx, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+
+		if out, err := exec.Command("git", "verify-pack", idx[0]).CombinedOutput(); err != nil {
+			t.Errorf("git verify-pack failed: %s\n%s", err, out)
+		}
+	}
+}
+
+func TestWritePackMissing(t *testing.T) {
+	if _, err := OpenRepo(t.TempDir()).WritePack(&bytes.Buffer{}, []PackObject{{ID: testID1}}); err == nil {
+		t.Error("expecting error writing missing object, got nil")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func (r *Repo) loadPackedRefsData() {
+	f, err := os.Open(filepath.Join(r.path, "packed-refs"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.packedRefsErr = fmt.Errorf("error opening packed-refs: %w", err)
+		}
+
+		return
+	}
+
+	data, err := io.ReadAll(f)
+
+	f.Close()
+
+	if err != nil {
+		r.packedRefsErr = fmt.Errorf("error reading packed-refs: %w", err)
+
+		return
+	}
+
+	r.packedRefs = make(map[string]string)
+
+	for _, line := range bytes.Split(data, newLine) {
+		if len(line) < 42 || line[0] == '#' || line[0] == '^' || line[40] != ' ' {
+			continue
+		}
+
+		if id := checkSHA(line[:40]); id != "" {
+			r.packedRefs[string(line[41:])] = id
+		}
+	}
+}
+
+func (r *Repo) readPackedRef(name string) (string, error) {
+	r.loadPackedRefs.Do(r.loadPackedRefsData)
+
+	if r.packedRefsErr != nil {
+		return "", r.packedRefsErr
+	}
+
+	id, ok := r.packedRefs[name]
+	if !ok {
+		return "", fmt.Errorf("unknown ref: %s", name)
+	}
+
+	return id, nil
+}
+
+// listRefs returns the object IDs of all of the refs that start with the
+// given prefix, keyed by full ref name.
+func (r *Repo) listRefs(prefix string) (map[string]string, error) {
+	refs := make(map[string]string)
+
+	if r.bundle {
+		bundleRefs, err := r.readBundleRefs()
+		if err != nil {
+			return nil, err
+		}
+
+		for name, id := range bundleRefs {
+			if strings.HasPrefix(name, prefix) {
+				refs[name] = id
+			}
+		}
+
+		return refs, nil
+	} else if r.hasRefTable() {
+		r.loadRefTable.Do(r.loadRefTableData)
+
+		if r.refTableErr != nil {
+			return nil, r.refTableErr
+		}
+
+		for name, ref := range r.refTable {
+			if ref.id != "" && strings.HasPrefix(name, prefix) {
+				refs[name] = ref.id
+			}
+		}
+
+		return refs, nil
+	}
+
+	r.loadPackedRefs.Do(r.loadPackedRefsData)
+
+	if r.packedRefsErr != nil {
+		return nil, r.packedRefsErr
+	}
+
+	for name, id := range r.packedRefs {
+		if strings.HasPrefix(name, prefix) {
+			refs[name] = id
+		}
+	}
+
+	refsDir := filepath.Join(r.path, "refs")
+
+	if err := filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(r.path, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		data = bytes.TrimSpace(data)
+
+		if bytes.HasPrefix(data, []byte("ref: ")) {
+			id, err := r.readRef(string(data[5:]))
+			if err == nil {
+				refs[name] = id
+			}
+
+			return nil // dangling symbolic refs are ignored
+		}
+
+		id := checkSHA(data)
+		if id == "" {
+			return fmt.Errorf("invalid id in ref: %s", name)
+		}
+
+		refs[name] = id
+
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("error reading refs: %w", err)
+	}
+
+	return refs, nil
+}
+
+func (r *Repo) loadReplaceData() {
+	if !r.noReplace {
+		const replacePrefix = "refs/replace/"
+
+		refs, err := r.listRefs(replacePrefix)
+		if err != nil {
+			r.replaceErr = fmt.Errorf("error reading replace refs: %w", err)
+
+			return
+		}
+
+		r.replace = make(map[string]string, len(refs))
+
+		for name, id := range refs {
+			r.replace[name[len(replacePrefix):]] = id
+		}
+	}
+
+	if r.bundle {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(r.path, "info", "grafts"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.replaceErr = fmt.Errorf("error opening grafts file: %w", err)
+		}
+
+		return
+	}
+
+	data, err := io.ReadAll(f)
+
+	f.Close()
+
+	if err != nil {
+		r.replaceErr = fmt.Errorf("error reading grafts file: %w", err)
+
+		return
+	}
+
+	r.grafts = make(map[string][]string)
+
+	for _, line := range bytes.Split(data, newLine) {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		ids := bytes.Fields(line)
+		if len(ids) == 0 {
+			continue
+		}
+
+		parents := make([]string, 0, len(ids))
+
+		for _, id := range ids {
+			if len(id) != 40 || checkSHA(id) == "" {
+				r.replaceErr = fmt.Errorf("invalid graft: %s", line)
+
+				return
+			}
+
+			parents = append(parents, string(id))
+		}
+
+		r.grafts[parents[0]] = parents[1:]
+	}
+}
+
+func (r *Repo) replacement(id string) (string, error) {
+	r.loadReplace.Do(r.loadReplaceData)
+
+	if r.replaceErr != nil {
+		return "", r.replaceErr
+	}
+
+	if rid, ok := r.replace[id]; ok {
+		return rid, nil
+	}
+
+	return id, nil
+}
+
+func (r *Repo) graft(id string) ([]string, bool) {
+	r.loadReplace.Do(r.loadReplaceData)
+
+	parents, ok := r.grafts[id]
+
+	return parents, ok
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testID1 = "1111111111111111111111111111111111111111"
+	testID2 = "2222222222222222222222222222222222222222"
+	testID3 = "3333333333333333333333333333333333333333"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListRefs(t *testing.T) {
+	for n, test := range [...]struct {
+		Files  map[string]string
+		Prefix string
+		Refs   map[string]string
+		Err    bool
+	}{
+		{ // 1
+			Files: map[string]string{
+				"packed-refs": "# pack-refs with: peeled fully-peeled sorted \n" +
+					testID1 + " refs/heads/main\n" +
+					testID2 + " refs/tags/v1\n" +
+					"^" + testID3 + "\n",
+			},
+			Prefix: "refs/",
+			Refs: map[string]string{
+				"refs/heads/main": testID1,
+				"refs/tags/v1":    testID2,
+			},
+		},
+		{ // 2
+			Files: map[string]string{
+				"packed-refs":     testID1 + " refs/heads/main\n" + testID2 + " refs/tags/v1\n",
+				"refs/heads/main": testID3 + "\n",
+			},
+			Prefix: "refs/heads/",
+			Refs: map[string]string{
+				"refs/heads/main": testID3,
+			},
+		},
+		{ // 3
+			Files: map[string]string{
+				"refs/heads/main":       testID1 + "\n",
+				"refs/remotes/o/HEAD":   "ref: refs/heads/main\n",
+				"refs/remotes/o/gone":   "ref: refs/heads/missing\n",
+				"refs/remotes/o/branch": testID2,
+			},
+			Prefix: "refs/remotes/",
+			Refs: map[string]string{
+				"refs/remotes/o/HEAD":   testID1,
+				"refs/remotes/o/branch": testID2,
+			},
+		},
+		{ // 4
+			Files: map[string]string{
+				"refs/heads/main": "not an id\n",
+			},
+			Prefix: "refs/",
+			Err:    true,
+		},
+		{ // 5
+			Prefix: "refs/",
+			Refs:   map[string]string{},
+		},
+	} {
+		dir := t.TempDir()
+
+		writeFiles(t, dir, test.Files)
+
+		refs, err := OpenRepo(dir).listRefs(test.Prefix)
+		if test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(refs, test.Refs) {
+			t.Errorf("test %d: expecting refs %v, got %v", n+1, test.Refs, refs)
+		}
+	}
+}
+
+func TestReplaceData(t *testing.T) {
+	for n, test := range [...]struct {
+		Files     map[string]string
+		NoReplace bool
+		Replace   map[string]string
+		Grafts    map[string][]string
+		Err       string
+	}{
+		{ // 1
+			Files: map[string]string{
+				"refs/replace/" + testID1: testID2 + "\n",
+				"info/grafts":             "# comment\n" + testID1 + " " + testID2 + " " + testID3 + "\n" + testID2 + "\n",
+			},
+			Replace: map[string]string{testID1: testID2},
+			Grafts: map[string][]string{
+				testID1: {testID2, testID3},
+				testID2: {},
+			},
+		},
+		{ // 2
+			Files: map[string]string{
+				"refs/replace/" + testID1: testID2 + "\n",
+			},
+			NoReplace: true,
+		},
+		{ // 3
+			Files: map[string]string{
+				"info/grafts": "\n  \t\n" + testID1 + "\n",
+			},
+			Replace: map[string]string{},
+			Grafts: map[string][]string{
+				testID1: {},
+			},
+		},
+		{ // 4
+			Files: map[string]string{
+				"info/grafts": testID1 + " 1234\n",
+			},
+			Replace: map[string]string{},
+			Err:     "invalid graft",
+		},
+	} {
+		dir := t.TempDir()
+
+		writeFiles(t, dir, test.Files)
+
+		r := OpenRepo(dir)
+		r.noReplace = test.NoReplace
+
+		r.loadReplaceData()
+
+		if test.Err != "" {
+			if r.replaceErr == nil || !strings.Contains(r.replaceErr.Error(), test.Err) {
+				t.Errorf("test %d: expecting error %q, got %v", n+1, test.Err, r.replaceErr)
+			}
+
+			continue
+		} else if r.replaceErr != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, r.replaceErr)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(r.replace, test.Replace) {
+			t.Errorf("test %d: expecting replacements %v, got %v", n+1, test.Replace, r.replace)
+		}
+
+		if len(r.grafts) != len(test.Grafts) {
+			t.Errorf("test %d: expecting grafts %v, got %v", n+1, test.Grafts, r.grafts)
+		}
+
+		for id, parents := range test.Grafts {
+			if got, ok := r.grafts[id]; !ok || len(got) != len(parents) || (len(got) > 0 && !reflect.DeepEqual(got, parents)) {
+				t.Errorf("test %d: expecting grafts for %s to be %v, got %v", n+1, id, parents, got)
+			}
+		}
+	}
+}
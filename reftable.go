@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	reftableBlockRef = 'r'
+
+	reftableDeletion = 0
+	reftableValue    = 1
+	reftableValues   = 2
+	reftableSymref   = 3
+)
+
+type reftableRef struct {
+	id, peeled, target string
+}
+
+func (r *Repo) loadRefTableData() {
+	if r.bundle {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(r.path, "reftable", "tables.list"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.refTableErr = fmt.Errorf("error opening reftable list: %w", err)
+		}
+
+		return
+	}
+
+	data, err := io.ReadAll(f)
+
+	f.Close()
+
+	if err != nil {
+		r.refTableErr = fmt.Errorf("error reading reftable list: %w", err)
+
+		return
+	}
+
+	refs := make(map[string]reftableRef)
+
+	for _, table := range bytes.Split(data, newLine) {
+		if len(table) == 0 {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(r.path, "reftable", string(table)))
+		if err != nil {
+			r.refTableErr = fmt.Errorf("error opening reftable %s: %w", table, err)
+
+			return
+		}
+
+		b, err := io.ReadAll(f)
+
+		f.Close()
+
+		if err != nil {
+			r.refTableErr = fmt.Errorf("error reading reftable %s: %w", table, err)
+
+			return
+		}
+
+		if err := readRefTable(b, refs); err != nil {
+			r.refTableErr = fmt.Errorf("error parsing reftable %s: %w", table, err)
+
+			return
+		}
+	}
+
+	r.refTable = refs
+}
+
+func readRefTable(data []byte, refs map[string]reftableRef) error {
+	if len(data) < 24 || string(data[:4]) != "REFT" {
+		return errors.New("invalid reftable header")
+	}
+
+	headerLen, footerLen := 24, 68
+
+	switch data[4] {
+	case 1:
+	case 2:
+		headerLen, footerLen = 28, 72
+
+		if len(data) < headerLen || string(data[24:28]) != "sha1" {
+			return errors.New("unsupported reftable hash")
+		}
+	default:
+		return fmt.Errorf("unsupported reftable version: %d", data[4])
+	}
+
+	end := len(data) - footerLen
+	if end < headerLen {
+		return errors.New("invalid reftable size")
+	}
+
+	for pos := 0; pos < end; {
+		header := pos
+
+		if pos == 0 {
+			header = headerLen
+		}
+
+		if header+4 > end {
+			return errors.New("invalid reftable block header")
+		}
+
+		if data[header] != reftableBlockRef {
+			break
+		}
+
+		blockEnd := pos + (int(data[header+1])<<16 | int(data[header+2])<<8 | int(data[header+3]))
+		if blockEnd > end || blockEnd < header+6 {
+			return errors.New("invalid reftable block length")
+		}
+
+		block := data[header+4 : blockEnd]
+		restarts := int(block[len(block)-2])<<8 | int(block[len(block)-1])
+
+		if 3*restarts+2 > len(block) {
+			return errors.New("invalid reftable restart count")
+		}
+
+		if err := readRefTableBlock(block[:len(block)-2-3*restarts], refs); err != nil {
+			return err
+		}
+
+		// blocks never start with a zero byte, so skip any alignment padding
+		for pos = blockEnd; pos < end && data[pos] == 0; pos++ {
+		}
+	}
+
+	return nil
+}
+
+func readRefTableBlock(block []byte, refs map[string]reftableRef) error {
+	var last []byte
+
+	for len(block) > 0 {
+		prefix, n := readRefTableVarint(block)
+		if n == 0 {
+			return errors.New("invalid reftable prefix length")
+		}
+
+		block = block[n:]
+
+		suffix, n := readRefTableVarint(block)
+		if n == 0 {
+			return errors.New("invalid reftable suffix length")
+		}
+
+		block = block[n:]
+		typ := suffix & 7
+		suffix >>= 3
+
+		if prefix > uint64(len(last)) || suffix > uint64(len(block)) {
+			return errors.New("invalid reftable record name")
+		}
+
+		name := append(append(make([]byte, 0, prefix+suffix), last[:prefix]...), block[:suffix]...)
+		block = block[suffix:]
+		last = name
+
+		if _, n = readRefTableVarint(block); n == 0 { // ignore update_index_delta
+			return errors.New("invalid reftable update index")
+		}
+
+		block = block[n:]
+
+		switch typ {
+		case reftableDeletion:
+			delete(refs, string(name))
+
+			continue
+		case reftableValue:
+			if len(block) < 20 {
+				return errors.New("invalid reftable value")
+			}
+
+			refs[string(name)] = reftableRef{id: fmt.Sprintf("%x", block[:20])}
+			block = block[20:]
+		case reftableValues:
+			if len(block) < 40 {
+				return errors.New("invalid reftable value")
+			}
+
+			refs[string(name)] = reftableRef{
+				id:     fmt.Sprintf("%x", block[:20]),
+				peeled: fmt.Sprintf("%x", block[20:40]),
+			}
+			block = block[40:]
+		case reftableSymref:
+			l, n := readRefTableVarint(block)
+			if n == 0 || uint64(len(block)-n) < l {
+				return errors.New("invalid reftable symref")
+			}
+
+			refs[string(name)] = reftableRef{target: string(block[n : n+int(l)])}
+			block = block[n+int(l):]
+		default:
+			return fmt.Errorf("invalid reftable value type: %d", typ)
+		}
+	}
+
+	return nil
+}
+
+// readRefTableVarint reads the offset style varint used throughout reftable
+// files, returning a zero length on error.
+func readRefTableVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+
+	val := uint64(b[0] & 0x7f)
+	n := 1
+
+	for b[n-1]&0x80 != 0 {
+		if n == len(b) || n == 10 {
+			return 0, 0
+		}
+
+		val = (val+1)<<7 | uint64(b[n]&0x7f)
+		n++
+	}
+
+	return val, n
+}
+
+func (r *Repo) readRefTableRef(name string) (reftableRef, error) {
+	r.loadRefTable.Do(r.loadRefTableData)
+
+	if r.refTableErr != nil {
+		return reftableRef{}, r.refTableErr
+	}
+
+	ref, ok := r.refTable[name]
+	if !ok {
+		return reftableRef{}, fmt.Errorf("unknown ref: %s", name)
+	}
+
+	return ref, nil
+}
+
+func (r *Repo) hasRefTable() bool {
+	r.loadRefTable.Do(r.loadRefTableData)
+
+	return r.refTableErr != nil || r.refTable != nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func testRefTableRecord(prefix int, suffix string, typ int, value ...string) []byte {
+	rec := append([]byte{byte(prefix), byte(len(suffix)<<3 | typ)}, suffix...)
+	rec = append(rec, 0)
+
+	for _, v := range value {
+		if typ == reftableSymref {
+			rec = append(append(rec, byte(len(v))), v...)
+		} else {
+			id, _ := hex.DecodeString(v)
+			rec = append(rec, id...)
+		}
+	}
+
+	return rec
+}
+
+func testRefTable(records ...[]byte) []byte {
+	data := append([]byte("REFT"), 1, 0, 0x10, 0)
+	data = append(data, make([]byte, 16)...)
+
+	var block []byte
+
+	for _, rec := range records {
+		block = append(block, rec...)
+	}
+
+	block = append(block, 0, 0, 28, 0, 1)
+	l := len(data) + 4 + len(block)
+	data = append(data, reftableBlockRef, byte(l>>16), byte(l>>8), byte(l))
+	data = append(data, block...)
+
+	return append(data, make([]byte, 68)...)
+}
+
+func TestReadRefTable(t *testing.T) {
+	for n, test := range [...]struct {
+		Data []byte
+		Refs map[string]reftableRef
+		Err  bool
+	}{
+		{ // 1
+			Data: testRefTable(
+				testRefTableRecord(0, "HEAD", reftableSymref, "refs/heads/main"),
+				testRefTableRecord(0, "refs/heads/main", reftableValue, testID1),
+				testRefTableRecord(5, "tags/v1", reftableValues, testID2, testID3),
+			),
+			Refs: map[string]reftableRef{
+				"HEAD":            {target: "refs/heads/main"},
+				"refs/heads/main": {id: testID1},
+				"refs/tags/v1":    {id: testID2, peeled: testID3},
+			},
+		},
+		{ // 2
+			Data: testRefTable(
+				testRefTableRecord(0, "refs/heads/a", reftableValue, testID1),
+				testRefTableRecord(11, "b", reftableValue, testID2),
+				testRefTableRecord(11, "c", reftableDeletion),
+			),
+			Refs: map[string]reftableRef{
+				"refs/heads/a": {id: testID1},
+				"refs/heads/b": {id: testID2},
+			},
+		},
+		{ // 3
+			Data: testRefTable(testRefTableRecord(0, "refs/heads/a", 7)),
+			Err:  true,
+		},
+		{ // 4
+			Data: testRefTable(testRefTableRecord(20, "refs/heads/a", reftableValue, testID1)),
+			Err:  true,
+		},
+		{ // 5
+			Data: testRefTable(testRefTableRecord(0, "refs/heads/a", reftableValue, testID1)[:20]),
+			Err:  true,
+		},
+		{ // 6
+			Data: append([]byte("RAFT"), testRefTable()[4:]...),
+			Err:  true,
+		},
+		{ // 7
+			Data: testRefTable()[:80],
+			Err:  true,
+		},
+	} {
+		refs := map[string]reftableRef{
+			"refs/heads/c": {id: testID3},
+		}
+
+		if err := readRefTable(test.Data, refs); test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if delete(refs, "refs/heads/c"); !reflect.DeepEqual(refs, test.Refs) {
+			t.Errorf("test %d: expecting refs %v, got %v", n+1, test.Refs, refs)
+		}
+	}
+}
+
+func TestReadRefTableVarint(t *testing.T) {
+	for n, test := range [...]struct {
+		Data  []byte
+		Value uint64
+		Len   int
+	}{
+		{Data: []byte{}},
+		{Data: []byte{5}, Value: 5, Len: 1},
+		{Data: []byte{0x7f, 0xff}, Value: 127, Len: 1},
+		{Data: []byte{0x80, 0x00}, Value: 128, Len: 2},
+		{Data: []byte{0xff, 0x7f}, Value: 16511, Len: 2},
+		{Data: []byte{0x80}},
+	} {
+		if v, l := readRefTableVarint(test.Data); v != test.Value || l != test.Len {
+			t.Errorf("test %d: expecting value %d with length %d, got %d with length %d", n+1, test.Value, test.Len, v, l)
+		}
+	}
+}
+
+func TestRefTableRepo(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFiles(t, dir, map[string]string{
+		"reftable/tables.list": "0x01.ref\n0x02.ref\n",
+		"reftable/0x01.ref": string(testRefTable(
+			testRefTableRecord(0, "HEAD", reftableSymref, "refs/heads/main"),
+			testRefTableRecord(0, "refs/heads/main", reftableValue, testID1),
+			testRefTableRecord(11, "old", reftableValue, testID2),
+		)),
+		"reftable/0x02.ref": string(testRefTable(
+			testRefTableRecord(0, "refs/heads/main", reftableValue, testID3),
+			testRefTableRecord(11, "old", reftableDeletion),
+		)),
+	})
+
+	r := OpenRepo(dir)
+
+	if id, err := r.GetLatestCommitID(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if id != testID3 {
+		t.Errorf("expecting HEAD to be %s, got %s", testID3, id)
+	}
+
+	refs, err := r.listRefs("refs/heads/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if expected := map[string]string{"refs/heads/main": testID3}; !reflect.DeepEqual(refs, expected) {
+		t.Errorf("expecting refs %v, got %v", expected, refs)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+)
+
+const renameLimit = 1000
+
+type renameMatch struct {
+	source, score int
+	copy          bool
+}
+
+type renameCandidate struct {
+	target, source, score int
+}
+
+type fingerprint struct {
+	size  int
+	lines map[uint64]int
+}
+
+func (r *Repo) fingerprint(id string, cache map[string]*fingerprint) (*fingerprint, error) {
+	if f, ok := cache[id]; ok {
+		return f, nil
+	}
+
+	data, err := r.readBlob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fingerprint{
+		size:  len(data),
+		lines: make(map[uint64]int),
+	}
+
+	for len(data) > 0 {
+		p := bytes.IndexByte(data, '\n') + 1
+		if p == 0 {
+			p = len(data)
+		}
+
+		h := fnv.New64a()
+
+		h.Write(data[:p])
+
+		f.lines[h.Sum64()] += p
+		data = data[p:]
+	}
+
+	cache[id] = f
+
+	return f, nil
+}
+
+func similarity(a, b *fingerprint) int {
+	max, min := a.size, b.size
+	if max < min {
+		max, min = min, max
+	}
+
+	if max == 0 {
+		return 100
+	}
+
+	var common int
+
+	for h, n := range b.lines {
+		if m := a.lines[h]; m < n {
+			common += m
+		} else {
+			common += n
+		}
+	}
+
+	return common * 100 / max
+}
+
+// DetectRenames pairs added paths with deleted paths whose contents are at
+// least threshold percent similar, turning them into renames. When copies is
+// set, added paths may also be paired as copies of modified or already
+// renamed paths.
+func (r *Repo) DetectRenames(changes []Change, threshold int, copies bool) ([]Change, error) {
+	var sources, targets []int
+
+	for n, c := range changes {
+		switch c.Type {
+		case ChangeDeleted:
+			sources = append(sources, n)
+		case ChangeModified:
+			if copies {
+				sources = append(sources, n)
+			}
+		case ChangeAdded:
+			targets = append(targets, n)
+		}
+	}
+
+	if len(sources) == 0 || len(targets) == 0 {
+		return changes, nil
+	}
+
+	matches := make(map[int]renameMatch)
+	used := make(map[int]bool)
+	byID := make(map[string][]int)
+
+	for _, s := range sources {
+		byID[changes[s].OldID] = append(byID[changes[s].OldID], s)
+	}
+
+	match := func(t, s, score int) bool {
+		if changes[s].Type == ChangeDeleted && !used[s] {
+			used[s] = true
+			matches[t] = renameMatch{source: s, score: score}
+		} else if copies {
+			matches[t] = renameMatch{source: s, score: score, copy: true}
+		} else {
+			return false
+		}
+
+		return true
+	}
+
+	var remaining []int
+
+	for _, t := range targets {
+		matched := false
+
+		for _, s := range byID[changes[t].NewID] {
+			if changes[s].OldType == changes[t].NewType && match(t, s, 100) {
+				matched = true
+
+				break
+			}
+		}
+
+		if !matched {
+			remaining = append(remaining, t)
+		}
+	}
+
+	if len(remaining) > 0 && threshold < 100 && len(remaining)*len(sources) <= renameLimit*renameLimit {
+		var candidates []renameCandidate
+
+		cache := make(map[string]*fingerprint)
+
+		for _, t := range remaining {
+			tf, err := r.fingerprint(changes[t].NewID, cache)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, s := range sources {
+				if changes[s].OldType != changes[t].NewType {
+					continue
+				}
+
+				sf, err := r.fingerprint(changes[s].OldID, cache)
+				if err != nil {
+					return nil, err
+				}
+
+				if score := similarity(sf, tf); score >= threshold {
+					candidates = append(candidates, renameCandidate{target: t, source: s, score: score})
+				}
+			}
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].score > candidates[j].score
+		})
+
+		for _, c := range candidates {
+			if _, ok := matches[c.target]; !ok {
+				match(c.target, c.source, c.score)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return changes, nil
+	}
+
+	detected := make([]Change, 0, len(changes))
+
+	for n, c := range changes {
+		if used[n] {
+			continue
+		}
+
+		if m, ok := matches[n]; ok {
+			s := changes[m.source]
+			c.Type = ChangeRenamed
+			c.OldPath = s.Path
+			c.OldID = s.OldID
+			c.OldType = s.OldType
+			c.Similarity = m.score
+
+			if m.copy {
+				c.Type = ChangeCopied
+			}
+		}
+
+		detected = append(detected, c)
+	}
+
+	sort.SliceStable(detected, func(i, j int) bool {
+		return detected[i].Path < detected[j].Path
+	})
+
+	return detected, nil
+}
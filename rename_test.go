@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSimilarity(t *testing.T) {
+	for n, test := range [...]struct {
+		A, B       string
+		Similarity int
+	}{
+		{Similarity: 100},
+		{A: "a\nb\nc\nd\n", B: "a\nb\nc\nd\n", Similarity: 100},
+		{A: "a\nb\nc\nd\n", B: "a\nb\nc\nD\n", Similarity: 75},
+		{A: "a\nb\n", B: "a\nb\nc\nd\n", Similarity: 50},
+		{A: "a\nb\n", B: "c\nd\n", Similarity: 0},
+		{A: "a\na\n", B: "a\n", Similarity: 50},
+	} {
+		dir := t.TempDir()
+		r := OpenRepo(dir)
+		cache := make(map[string]*fingerprint)
+
+		var ida, idb string
+
+		if test.A != "" {
+			ida = testObject(t, dir, ObjectBlob, test.A)
+		}
+
+		if test.B != "" {
+			idb = testObject(t, dir, ObjectBlob, test.B)
+		}
+
+		a, err := r.fingerprint(ida, cache)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		b, err := r.fingerprint(idb, cache)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", n+1, err)
+		}
+
+		if s := similarity(a, b); s != test.Similarity {
+			t.Errorf("test %d: expecting similarity %d, got %d", n+1, test.Similarity, s)
+		}
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	dir := t.TempDir()
+	text := strings.Repeat("line\n", 9)
+	orig := testObject(t, dir, ObjectBlob, text+"orig\n")
+	edited := testObject(t, dir, ObjectBlob, text+"edited\n")
+	other := testObject(t, dir, ObjectBlob, "other\n")
+	modified := testObject(t, dir, ObjectBlob, "modified\n")
+
+	for n, test := range [...]struct {
+		Changes   []Change
+		Threshold int
+		Copies    bool
+		Detected  []Change
+	}{
+		{ // 1
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: orig},
+			},
+			Threshold: 50,
+			Detected: []Change{
+				{Type: ChangeRenamed, Path: "b", OldPath: "a", OldID: orig, NewID: orig, Similarity: 100},
+			},
+		},
+		{ // 2
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: edited},
+				{Type: ChangeAdded, Path: "c", NewID: other},
+			},
+			Threshold: 50,
+			Detected: []Change{
+				{Type: ChangeRenamed, Path: "b", OldPath: "a", OldID: orig, NewID: edited, Similarity: 86},
+				{Type: ChangeAdded, Path: "c", NewID: other},
+			},
+		},
+		{ // 3
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: edited},
+			},
+			Threshold: 90,
+			Detected: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: edited},
+			},
+		},
+		{ // 4
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: orig},
+				{Type: ChangeAdded, Path: "c", NewID: orig},
+			},
+			Threshold: 50,
+			Detected: []Change{
+				{Type: ChangeRenamed, Path: "b", OldPath: "a", OldID: orig, NewID: orig, Similarity: 100},
+				{Type: ChangeAdded, Path: "c", NewID: orig},
+			},
+		},
+		{ // 5
+			Changes: []Change{
+				{Type: ChangeModified, Path: "a", OldID: orig, NewID: modified},
+				{Type: ChangeAdded, Path: "b", NewID: edited},
+			},
+			Threshold: 50,
+			Copies:    true,
+			Detected: []Change{
+				{Type: ChangeModified, Path: "a", OldID: orig, NewID: modified},
+				{Type: ChangeCopied, Path: "b", OldPath: "a", OldID: orig, NewID: edited, Similarity: 86},
+			},
+		},
+		{ // 6
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: orig, NewType: EntrySymlink},
+			},
+			Threshold: 50,
+			Detected: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: orig},
+				{Type: ChangeAdded, Path: "b", NewID: orig, NewType: EntrySymlink},
+			},
+		},
+	} {
+		detected, err := OpenRepo(dir).DetectRenames(test.Changes, test.Threshold, test.Copies)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(detected, test.Detected) {
+			t.Errorf("test %d: expecting changes %v, got %v", n+1, test.Detected, detected)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	searchMaxSize   = 1 << 20
+	searchBinaryLen = 8000
+
+	// searchVersion is the version of the search index format, which is
+	// increased whenever the index is changed in a way that search.js must
+	// know about.
+	searchVersion = 1
+
+	// searchChunkSize is the number of documents in each file under
+	// search/docs/, so that a search only downloads the documents it matches.
+	searchChunkSize = 256
+)
+
+// searchScript searches the indexes written by buildSearchIndex.
+//
+//go:embed search.js
+var searchScript []byte
+
+// SearchDoc is a document in the search index, which is either a file in the
+// latest tree or a commit. Paths are relative to the repo directory, with Page
+// being the page to link to for the document.
+type SearchDoc struct {
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	Raw     string `json:"raw,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Message string `json:"message,omitempty"`
+	Page    string `json:"page,omitempty"`
+}
+
+// SearchInfo describes a search index, whose documents are split into chunks
+// of ChunkSize, with document n being at position n%ChunkSize in
+// search/docs/<n/ChunkSize>.json. The posting lists in the index shards refer
+// to the documents by n. Shards lists the index shards that exist, so that a
+// missing shard can be told apart from a failure to fetch one.
+type SearchInfo struct {
+	Version   int      `json:"version"`
+	Docs      int      `json:"docs"`
+	ChunkSize int      `json:"chunkSize"`
+	Shards    []string `json:"shards"`
+}
+
+// searchIndex maps the trigrams of ASCII lowercased text to the sorted list of
+// documents containing them.
+type searchIndex struct {
+	docs     []SearchDoc
+	postings map[[3]byte][]int
+}
+
+func (s *searchIndex) add(doc SearchDoc, text []byte) {
+	id := len(s.docs)
+	s.docs = append(s.docs, doc)
+
+	var t [3]byte
+
+	for n, c := range text {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+
+		t[0], t[1], t[2] = t[1], t[2], c
+
+		if n < 2 {
+			continue
+		}
+
+		if p := s.postings[t]; len(p) == 0 || p[len(p)-1] != id {
+			s.postings[t] = append(p, id)
+		}
+	}
+}
+
+func (s *searchIndex) addDir(r *Repo, d *Dir) error {
+	names := make([]string, 0, len(d.Dirs))
+
+	for name := range d.Dirs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := s.addDir(r, d.Dirs[name]); err != nil {
+			return err
+		}
+	}
+
+	names = names[:0]
+
+	for name := range d.Files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := d.Files[name]
+		page := f.PrettyPath
+
+		if page == "" {
+			page = f.RawPath
+		}
+
+		// a match in a file without an output couldn't be checked by
+		// the search script
+		if f.Link != "" || f.Size > searchMaxSize || page == "" {
+			continue
+		}
+
+		data, err := r.readBlob(f.ID)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Path, err)
+		}
+
+		check := data
+		if len(check) > searchBinaryLen {
+			check = check[:searchBinaryLen]
+		}
+
+		if bytes.IndexByte(check, 0) >= 0 {
+			continue
+		}
+
+		s.add(SearchDoc{Type: "file", Path: f.Path, Raw: f.RawPath, Page: page}, data)
+	}
+
+	return nil
+}
+
+// searchStale returns true when the search index is missing or was written for
+// a different commit, the time of its info file being set to that of the
+// commit.
+func searchStale(repo string, latest *Commit) (bool, error) {
+	fi, err := os.Stat(filepath.Join(config.OutputDir, repo, "search", "index.json"))
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("error stat'ing search index file: %w", err)
+	}
+
+	return !fi.ModTime().Equal(latest.Time), nil
+}
+
+// buildSearchIndex writes a trigram index of the files in the latest tree and
+// of the messages of all commits, as described by search/index.json. The
+// posting lists are sharded by the first byte of the trigram, with each shard,
+// search/<byte in hex>.json, mapping the hex of a trigram to the list of
+// documents containing it. The index is given the time of the latest commit.
+func buildSearchIndex(repo string, r *Repo, root *Dir, latest *Commit, commits []*Commit) error {
+	s := &searchIndex{postings: make(map[[3]byte][]int)}
+
+	if err := s.addDir(r, root); err != nil {
+		return err
+	}
+
+	for _, c := range commits {
+		doc := SearchDoc{Type: "commit", ID: c.ID, Message: c.Msg}
+
+		if config.CommitTemplate != "" {
+			doc.Page = "commit/" + c.ID + ".html"
+		}
+
+		s.add(doc, []byte(c.Msg))
+	}
+
+	dir := filepath.Join(config.OutputDir, repo, "search")
+	chunks := make(map[string]struct{})
+
+	for n := 0; n < len(s.docs); n += searchChunkSize {
+		end := n + searchChunkSize
+		if end > len(s.docs) {
+			end = len(s.docs)
+		}
+
+		name := strconv.Itoa(n/searchChunkSize) + ".json"
+		chunks[name] = struct{}{}
+
+		if err := writeJSON(filepath.Join(dir, "docs", name), s.docs[n:end]); err != nil {
+			return err
+		}
+	}
+
+	shards := map[string]struct{}{"index.json": {}}
+	postings := make(map[string]map[string][]int)
+
+	for t, docs := range s.postings {
+		name := fmt.Sprintf("%02x.json", t[0])
+
+		shard, ok := postings[name]
+		if !ok {
+			shard = make(map[string][]int)
+			postings[name] = shard
+			shards[name] = struct{}{}
+		}
+
+		shard[fmt.Sprintf("%02x%02x%02x", t[0], t[1], t[2])] = docs
+	}
+
+	info := SearchInfo{
+		Version:   searchVersion,
+		Docs:      len(s.docs),
+		ChunkSize: searchChunkSize,
+		Shards:    make([]string, 0, len(postings)),
+	}
+
+	for name, shard := range postings {
+		if err := writeJSON(filepath.Join(dir, name), shard); err != nil {
+			return err
+		}
+
+		info.Shards = append(info.Shards, strings.TrimSuffix(name, ".json"))
+	}
+
+	sort.Strings(info.Shards)
+
+	if err := removeOldSearchFiles(filepath.Join(dir, "docs"), chunks); err != nil {
+		return err
+	}
+
+	if err := removeOldSearchFiles(dir, shards); err != nil {
+		return err
+	}
+
+	// the info file is written last, so that a failure above leaves the
+	// index stale and the next build tries again
+	path := filepath.Join(dir, "index.json")
+
+	if err := writeJSON(path, info); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(path, latest.Time, latest.Time); err != nil {
+		return fmt.Errorf("error setting search index file time: %w", err)
+	}
+
+	return nil
+}
+
+// removeOldSearchFiles removes the JSON files in a search directory that are
+// not wanted.
+func removeOldSearchFiles(dir string, wanted map[string]struct{}) error {
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading search directory: %w", err)
+	}
+
+	for _, f := range files {
+		if _, ok := wanted[f.Name()]; !ok && strings.HasSuffix(f.Name(), ".json") {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return fmt.Errorf("error removing old search file: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildSearchScript writes the script that searches the repo indexes to the
+// root of the output directory, removing it when they aren't being built.
+func buildSearchScript() error {
+	path := filepath.Join(config.OutputDir, "search.js")
+
+	if config.SearchIndex {
+		return writeIfChanged(path, searchScript)
+	} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing search script: %w", err)
+	}
+
+	return nil
+}
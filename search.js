@@ -0,0 +1,110 @@
+"use strict";
+
+// gitwebSearch searches the index of the repo at the given URL, which must end
+// in a slash, for the query, ignoring ASCII case. It resolves to a list of the
+// matching documents, each with the matching lines of files, and the page to
+// link to, resolved against the repo URL. It rejects if any part of the index,
+// or a file needed to check a match, can't be fetched.
+const gitwebSearch = (() => {
+	const searchVersion = 1,
+	      cache = new Map(),
+	      get = url => fetch(url).then(r => {
+		if (!r.ok) {
+			throw new Error(`error fetching ${url}: ${r.status} ${r.statusText}`);
+		}
+
+		return r;
+	      }),
+	      getJSON = url => {
+		if (!cache.has(url)) {
+			cache.set(url, get(url).then(r => r.json()).catch(e => {
+				cache.delete(url);
+
+				throw e;
+			}));
+		}
+
+		return cache.get(url);
+	      },
+	      getText = url => get(url).then(r => r.text()),
+	      encodePath = p => p.split("/").map(encodeURIComponent).join("/"),
+	      hex = b => b.toString(16).padStart(2, "0"),
+	      fold = s => s.replace(/[A-Z]/g, c => c.toLowerCase()),
+	      intersect = (a, b) => {
+		const r = [];
+
+		for (let i = 0, j = 0; i < a.length && j < b.length;) {
+			if (a[i] < b[j]) {
+				i++;
+			} else if (a[i] > b[j]) {
+				j++;
+			} else {
+				r.push(a[i]);
+				i++;
+				j++;
+			}
+		}
+
+		return r;
+	      },
+	      matchingLines = (text, query) => text.split("\n").map((line, n) => ({"line": n + 1, "text": line})).filter(l => fold(l.text).includes(query)),
+	      pageText = html => new DOMParser().parseFromString(html, "text/html").body.textContent;
+
+	return async (repoURL, query, limit = 50) => {
+		const q = fold(query),
+		      bytes = new TextEncoder().encode(q),
+		      grams = new Set();
+
+		for (let i = 0; i + 3 <= bytes.length; i++) {
+			grams.add(hex(bytes[i]) + hex(bytes[i + 1]) + hex(bytes[i + 2]));
+		}
+
+		if (!grams.size) {
+			return [];
+		}
+
+		const base = new URL(repoURL, location.href),
+		      index = await getJSON(repoURL + "search/index.json");
+
+		if (index.version !== searchVersion) {
+			throw new Error(`unsupported search index version: ${index.version}`);
+		}
+
+		const shards = new Set(index.shards),
+		      lists = await Promise.all(Array.from(grams, g => shards.has(g.slice(0, 2)) ? getJSON(repoURL + "search/" + g.slice(0, 2) + ".json").then(shard => shard[g] || []) : [])),
+		      results = [];
+
+		for (const id of lists.reduce(intersect)) {
+			if (results.length === limit) {
+				break;
+			}
+
+			const chunk = await getJSON(repoURL + "search/docs/" + Math.floor(id / index.chunkSize) + ".json"),
+			      doc = Object.assign({}, chunk[id % index.chunkSize]);
+
+			if (doc.type === "commit") {
+				if (!fold(doc.message).includes(q)) {
+					continue;
+				}
+			} else if (doc.raw) {
+				if (!(doc.lines = matchingLines(await getText(new URL(encodePath(doc.raw), base).href), q)).length) {
+					continue;
+				}
+			} else if (doc.page) {
+				if (!(doc.lines = matchingLines(pageText(await getText(new URL(encodePath(doc.page), base).href)), q)).length) {
+					continue;
+				}
+			} else {
+				continue;
+			}
+
+			if (doc.page) {
+				doc.page = new URL(encodePath(doc.page), base).href;
+			}
+
+			results.push(doc);
+		}
+
+		return results;
+	};
+})();
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSearchIndexAdd(t *testing.T) {
+	for n, test := range [...]struct {
+		Texts    []string
+		Postings map[string][]int
+	}{
+		{ // 1
+			Texts:    []string{"ab"},
+			Postings: map[string][]int{},
+		},
+		{ // 2
+			Texts:    []string{"abc"},
+			Postings: map[string][]int{"abc": {0}},
+		},
+		{ // 3
+			Texts:    []string{"ABcD", "bcd"},
+			Postings: map[string][]int{"abc": {0}, "bcd": {0, 1}},
+		},
+		{ // 4
+			Texts:    []string{"aaaa", "xyz", "AAA"},
+			Postings: map[string][]int{"aaa": {0, 2}, "xyz": {1}},
+		},
+		{ // 5
+			Texts:    []string{"é!"},
+			Postings: map[string][]int{"\xc3\xa9!": {0}},
+		},
+	} {
+		s := &searchIndex{postings: make(map[[3]byte][]int)}
+
+		for _, text := range test.Texts {
+			s.add(SearchDoc{Type: "file"}, []byte(text))
+		}
+
+		postings := make(map[string][]int, len(s.postings))
+
+		for t, docs := range s.postings {
+			postings[string(t[:])] = docs
+		}
+
+		if !reflect.DeepEqual(postings, test.Postings) {
+			t.Errorf("test %d: expecting postings %v, got %v", n+1, test.Postings, postings)
+		}
+	}
+}
+
+func TestBuildSearchIndex(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	config.CommitTemplate = "commit.tmpl"
+
+	dir := filepath.Join(config.OutputDir, "repo", "search")
+
+	writeFiles(t, dir, map[string]string{
+		"docs.json":   "{}",
+		"ff.json":     "{}",
+		"docs/9.json": "[]",
+	})
+
+	base := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	commits := make([]*Commit, searchChunkSize+2)
+
+	for n := range commits {
+		commits[n] = &Commit{ID: strconv.Itoa(n), Msg: "commit " + strconv.Itoa(n), Time: base.Add(-time.Duration(n) * time.Hour)}
+	}
+
+	commits[1].Msg = "XYZ"
+
+	// a file without an output is skipped without being read
+	root := &Dir{Dirs: map[string]*Dir{}, Files: map[string]*File{"x.txt": {ID: testID1, Path: "x.txt"}}}
+
+	if stale, err := searchStale("repo", commits[0]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !stale {
+		t.Error("expecting missing search index to be stale")
+	}
+
+	if err := buildSearchIndex("repo", OpenRepo(t.TempDir()), root, commits[0], commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if stale, err := searchStale("repo", commits[0]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if stale {
+		t.Error("expecting search index not to be stale after building")
+	}
+
+	var info SearchInfo
+
+	readJSON(t, filepath.Join(dir, "index.json"), &info)
+
+	if expected := (SearchInfo{Version: searchVersion, Docs: len(commits), ChunkSize: searchChunkSize, Shards: []string{"20", "31", "32", "63", "69", "6d", "6f", "74", "78"}}); !reflect.DeepEqual(info, expected) {
+		t.Errorf("expecting info %+v, got %+v", expected, info)
+	}
+
+	var files []string
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+
+		return err
+	})
+
+	sort.Strings(files)
+
+	expected := []string{"20.json", "31.json", "32.json", "63.json", "69.json", "6d.json", "6f.json", "74.json", "78.json", "docs/0.json", "docs/1.json", "index.json"}
+
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expecting files %v, got %v", expected, files)
+	}
+
+	var shard map[string][]int
+
+	readJSON(t, filepath.Join(dir, "78.json"), &shard)
+
+	if docs := shard["78797a"]; !reflect.DeepEqual(docs, []int{1}) {
+		t.Errorf("expecting xyz to be in doc 1, got %v", docs)
+	}
+
+	var chunk []SearchDoc
+
+	readJSON(t, filepath.Join(dir, "docs", "1.json"), &chunk)
+
+	if len(chunk) != 2 {
+		t.Fatalf("expecting 2 docs in the last chunk, got %d", len(chunk))
+	}
+
+	if expected := (SearchDoc{Type: "commit", ID: commits[searchChunkSize+1].ID, Message: commits[searchChunkSize+1].Msg, Page: "commit/" + commits[searchChunkSize+1].ID + ".html"}); chunk[1] != expected {
+		t.Errorf("expecting doc %+v, got %+v", expected, chunk[1])
+	}
+
+	latest := &Commit{ID: "latest", Time: base.Add(time.Hour)}
+
+	if err := buildSearchIndex("repo", OpenRepo(t.TempDir()), root, latest, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if stale, err := searchStale("repo", latest); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if stale {
+		t.Error("expecting search index without commits to have the time of the latest commit")
+	}
+}
+
+func TestBuildSearchScript(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	path := filepath.Join(config.OutputDir, "search.js")
+
+	for n, test := range [...]struct {
+		Enabled, Exists bool
+	}{
+		{Enabled: true, Exists: true},
+		{Enabled: true, Exists: true},
+		{Enabled: false, Exists: false},
+		{Enabled: false, Exists: false},
+	} {
+		config.SearchIndex = test.Enabled
+
+		if err := buildSearchScript(); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if exists := fileExists(path); exists != test.Exists {
+			t.Errorf("test %d: expecting search.js to exist: %v, got %v", n+1, test.Exists, exists)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	pktFlush = 0
+	pktDelim = 1
+	pktMax   = 65520
+
+	// maxRequest limits the size of an upload-pack request, both as sent and
+	// once decompressed.
+	maxRequest = 1 << 20
+
+	bandData  = 1
+	bandError = 3
+)
+
+var capabilities = [...]string{
+	"version 2",
+	"agent=gitweb",
+	"ls-refs",
+	"fetch",
+	"object-format=sha1",
+}
+
+// serve serves the output directory, along with read-only clones of the repos
+// using version 2 of the smart HTTP protocol.
+func serve(addr string) error {
+	return http.ListenAndServe(addr, &server{
+		files: http.FileServer(http.Dir(config.OutputDir)),
+	})
+}
+
+type server struct {
+	files http.Handler
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// clients not speaking version 2 of the protocol fall through to the
+	// files, which may contain a dumb HTTP mirror of the repo
+	if repo, endpoint, ok := smartPath(r.URL.Path); ok && strings.Contains(":"+r.Header.Get("Git-Protocol")+":", ":version=2:") {
+		switch endpoint {
+		case "info/refs":
+			if r.Method == http.MethodGet && r.URL.Query().Get("service") == "git-upload-pack" {
+				w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+				w.Header().Set("Cache-Control", "no-cache")
+
+				for _, c := range capabilities {
+					io.WriteString(w, pktLine(c+"\n"))
+				}
+
+				io.WriteString(w, "0000")
+
+				return
+			}
+		case "git-upload-pack":
+			if r.Method == http.MethodPost {
+				uploadPack(w, r, repo)
+
+				return
+			}
+		}
+	}
+
+	s.files.ServeHTTP(w, r)
+}
+
+// smartPath splits a URL path of the form /repo.git/endpoint, returning true
+// if the repo exists.
+func smartPath(p string) (string, string, bool) {
+	p = strings.TrimPrefix(p, "/")
+
+	pos := strings.Index(p, ".git/")
+	if pos <= 0 {
+		return "", "", false
+	}
+
+	repo := p[:pos]
+
+	if strings.ContainsAny(repo, "/\\") || repo[0] == '.' {
+		return "", "", false
+	}
+
+	if _, err := os.Stat(repoPath(repo)); err != nil {
+		return "", "", false
+	}
+
+	return repo, p[pos+5:], true
+}
+
+func uploadPack(w http.ResponseWriter, req *http.Request, repo string) {
+	body := io.Reader(http.MaxBytesReader(w, req.Body, maxRequest))
+
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		z, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		body = io.LimitReader(z, maxRequest)
+	}
+
+	command, args, err := readCommand(bufio.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	bw := bufio.NewWriter(w)
+	r := OpenRepo(repoPath(repo))
+
+	switch command {
+	case "ls-refs":
+		err = r.lsRefs(bw, args)
+	case "fetch":
+		err = r.fetch(bw, args)
+	case "":
+	default:
+		err = fmt.Errorf("unknown command: %s", command)
+	}
+
+	if err != nil {
+		io.WriteString(bw, pktLine("ERR "+err.Error()+"\n"))
+	}
+
+	bw.Flush()
+}
+
+func pktLine(line string) string {
+	return fmt.Sprintf("%04x%s", len(line)+4, line)
+}
+
+// readPkt reads a single pkt-line, returning the size of special packets
+// instead of a line.
+func readPkt(r *bufio.Reader) (string, int, error) {
+	var size [4]byte
+
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", 0, fmt.Errorf("error reading pkt-line length: %w", err)
+	}
+
+	l, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid pkt-line length: %w", err)
+	} else if l < 4 {
+		return "", int(l), nil
+	}
+
+	line := make([]byte, l-4)
+
+	if _, err := io.ReadFull(r, line); err != nil {
+		return "", 0, fmt.Errorf("error reading pkt-line: %w", err)
+	}
+
+	return strings.TrimSuffix(string(line), "\n"), int(l), nil
+}
+
+// readCommand reads a version 2 request, returning the command and its
+// arguments. Capabilities sent by the client are ignored.
+func readCommand(r *bufio.Reader) (string, []string, error) {
+	var command string
+
+	for {
+		line, size, err := readPkt(r)
+		if err != nil {
+			return "", nil, err
+		} else if size == pktFlush {
+			return command, nil, nil
+		} else if size == pktDelim {
+			break
+		} else if strings.HasPrefix(line, "command=") {
+			command = line[8:]
+		}
+	}
+
+	var args []string
+
+	for {
+		line, size, err := readPkt(r)
+		if err != nil {
+			return "", nil, err
+		} else if size == pktFlush {
+			return command, args, nil
+		} else if size == pktDelim {
+			return "", nil, errors.New("unexpected delimiter")
+		}
+
+		args = append(args, line)
+	}
+}
+
+// lsRefs answers an ls-refs command, listing HEAD and the refs with any of the
+// requested prefixes.
+func (r *Repo) lsRefs(w io.Writer, args []string) error {
+	var (
+		symrefs, peel bool
+		prefixes      []string
+	)
+
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, arg[11:])
+		}
+	}
+
+	refs, err := r.listRefs("refs/")
+	if err != nil {
+		return fmt.Errorf("error reading refs: %w", err)
+	}
+
+	names := make([]string, 0, len(refs)+1)
+
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	head, err := r.readHeadRef()
+	if err == nil {
+		if id, err := r.readRef(head); err == nil {
+			refs["HEAD"] = id
+			names = append([]string{"HEAD"}, names...)
+		}
+	}
+
+	for _, name := range names {
+		if len(prefixes) > 0 && !hasAnyPrefix(name, prefixes) {
+			continue
+		}
+
+		line := refs[name] + " " + name
+
+		if symrefs && name == "HEAD" && head != "HEAD" {
+			line += " symref-target:" + head
+		}
+
+		if peel && strings.HasPrefix(name, "refs/tags/") {
+			peeled, _, err := r.peel(refs[name])
+			if err != nil {
+				return fmt.Errorf("error peeling %s: %w", name, err)
+			} else if peeled != refs[name] {
+				line += " peeled:" + peeled
+			}
+		}
+
+		io.WriteString(w, pktLine(line+"\n"))
+	}
+
+	_, err = io.WriteString(w, "0000")
+
+	return err
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetch answers a fetch command, acknowledging any common objects and, once
+// the client is done or there is common history, sending a pack of the
+// objects the client is missing.
+// isObjectID reports whether the ID is a full object ID in lowercase hex, as
+// sent by git.
+func isObjectID(id string) bool {
+	if len(id) != 40 {
+		return false
+	}
+
+	for _, c := range []byte(id) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Repo) fetch(w io.Writer, args []string) error {
+	var (
+		wants, haves     []string
+		done, includeTag bool
+	)
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			wants = append(wants, arg[5:])
+		case strings.HasPrefix(arg, "have "):
+			haves = append(haves, arg[5:])
+		case arg == "done":
+			done = true
+		case arg == "include-tag":
+			includeTag = true
+		}
+	}
+
+	for _, ids := range [...][]string{wants, haves} {
+		for _, id := range ids {
+			if !isObjectID(id) {
+				return fmt.Errorf("upload-pack: invalid object ID %q", id)
+			}
+		}
+	}
+
+	tips, err := r.refTips()
+	if err != nil {
+		return err
+	}
+
+	for _, want := range wants {
+		if _, ok := tips[want]; !ok {
+			return fmt.Errorf("upload-pack: not our ref %s", want)
+		}
+	}
+
+	common := make([]string, 0, len(haves))
+
+	for _, have := range haves {
+		if _, err := r.readObjectType(have); err == nil {
+			common = append(common, have)
+		}
+	}
+
+	if !done {
+		io.WriteString(w, pktLine("acknowledgments\n"))
+
+		if len(common) == 0 {
+			io.WriteString(w, pktLine("NAK\n"))
+			_, err := io.WriteString(w, "0000")
+
+			return err
+		}
+
+		for _, id := range common {
+			io.WriteString(w, pktLine("ACK "+id+"\n"))
+		}
+
+		io.WriteString(w, pktLine("ready\n")+"0001")
+	}
+
+	objects, err := r.reachableObjects(wants, common)
+	if err != nil {
+		return err
+	}
+
+	if includeTag {
+		objects = r.includeTags(objects)
+	}
+
+	io.WriteString(w, pktLine("packfile\n"))
+
+	sw := bufio.NewWriterSize(&sideband{w: w, band: bandData}, pktMax-5)
+
+	if _, err := r.WritePack(sw, objects); err != nil {
+		sw.Flush()
+		io.WriteString(&sideband{w: w, band: bandError}, err.Error()+"\n")
+	} else if err := sw.Flush(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "0000")
+
+	return err
+}
+
+// refTips returns the set of objects a client may ask for, which is the refs
+// and the objects that tags point to.
+func (r *Repo) refTips() (map[string]struct{}, error) {
+	refs, err := r.listRefs("refs/")
+	if err != nil {
+		return nil, fmt.Errorf("error reading refs: %w", err)
+	}
+
+	tips := make(map[string]struct{}, len(refs))
+
+	for _, id := range refs {
+		tips[id] = struct{}{}
+
+		if peeled, _, err := r.peel(id); err == nil {
+			tips[peeled] = struct{}{}
+		}
+	}
+
+	if id, err := r.GetLatestCommitID(); err == nil {
+		tips[id] = struct{}{}
+	}
+
+	return tips, nil
+}
+
+// includeTags adds any annotated tags that point to objects being sent.
+func (r *Repo) includeTags(objects []PackObject) []PackObject {
+	tags, err := r.listRefs("refs/tags/")
+	if err != nil {
+		return objects
+	}
+
+	sending := make(map[string]struct{}, len(objects))
+
+	for _, o := range objects {
+		sending[o.ID] = struct{}{}
+	}
+
+	for _, id := range tags {
+		if _, ok := sending[id]; ok {
+			continue
+		}
+
+		typ, data, err := r.readRaw(id)
+		if err != nil || typ != ObjectTag {
+			continue
+		}
+
+		if p := bytes.IndexByte(data, '\n'); p > 7 && bytes.HasPrefix(data, []byte("object ")) {
+			if _, ok := sending[string(data[7:p])]; ok {
+				objects = append(objects, PackObject{ID: id})
+				sending[id] = struct{}{}
+			}
+		}
+	}
+
+	return objects
+}
+
+// sideband writes data as pkt-lines on a single band of the multiplexed
+// packfile stream.
+type sideband struct {
+	w    io.Writer
+	band byte
+}
+
+func (s *sideband) Write(p []byte) (int, error) {
+	var n int
+
+	for len(p) > 0 {
+		l := len(p)
+		if l > pktMax-5 {
+			l = pktMax - 5
+		}
+
+		if _, err := fmt.Fprintf(s.w, "%04x%c", l+5, s.band); err != nil {
+			return n, err
+		}
+
+		m, err := s.w.Write(p[:l])
+
+		n += m
+
+		if err != nil {
+			return n, err
+		}
+
+		p = p[l:]
+	}
+
+	return n, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadPkt(t *testing.T) {
+	for n, test := range [...]struct {
+		Data string
+		Line string
+		Size int
+		Err  bool
+	}{
+		{Data: "0000", Size: pktFlush},
+		{Data: "0001", Size: pktDelim},
+		{Data: "0009done\n", Line: "done", Size: 9},
+		{Data: "0008done", Line: "done", Size: 8},
+		{Data: "000adone\n", Err: true},
+		{Data: "00", Err: true},
+		{Data: "zzzz", Err: true},
+	} {
+		line, size, err := readPkt(bufio.NewReader(strings.NewReader(test.Data)))
+		if test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if line != test.Line || size != test.Size {
+			t.Errorf("test %d: expecting line %q (%d), got %q (%d)", n+1, test.Line, test.Size, line, size)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	for n, test := range [...]struct {
+		Data    string
+		Command string
+		Args    []string
+		Err     bool
+	}{
+		{ // 1
+			Data: "0000",
+		},
+		{ // 2
+			Data:    pktLine("command=ls-refs\n") + pktLine("agent=git/2\n") + "0001" + pktLine("peel\n") + pktLine("symrefs\n") + "0000",
+			Command: "ls-refs",
+			Args:    []string{"peel", "symrefs"},
+		},
+		{ // 3
+			Data:    pktLine("command=fetch\n") + "0000",
+			Command: "fetch",
+		},
+		{ // 4
+			Data: pktLine("command=fetch\n") + "0001" + pktLine("done\n") + "0001",
+			Err:  true,
+		},
+		{ // 5
+			Data: pktLine("command=fetch\n") + "0001" + pktLine("done\n"),
+			Err:  true,
+		},
+	} {
+		command, args, err := readCommand(bufio.NewReader(strings.NewReader(test.Data)))
+		if test.Err {
+			if err == nil {
+				t.Errorf("test %d: expecting error, got nil", n+1)
+			}
+		} else if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if command != test.Command || !reflect.DeepEqual(args, test.Args) {
+			t.Errorf("test %d: expecting command %q %v, got %q %v", n+1, test.Command, test.Args, command, args)
+		}
+	}
+}
+
+// testServer sets the config to serve the repo created by testGitRepo,
+// returning its name and git directory.
+func testServer(t *testing.T) (string, string) {
+	t.Helper()
+
+	gitDir := testGitRepo(t)
+	saved := config
+
+	t.Cleanup(func() { config = saved })
+
+	config.ReposDir = filepath.Dir(filepath.Dir(gitDir))
+	config.GitDir = ".git"
+	config.OutputDir = t.TempDir()
+
+	return filepath.Base(filepath.Dir(gitDir)), gitDir
+}
+
+func testUploadPack(t *testing.T, repo string, body io.Reader, gzipped bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/"+repo+".git/git-upload-pack", body)
+	req.Header.Set("Git-Protocol", "version=2")
+
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	w := httptest.NewRecorder()
+
+	(&server{files: http.NotFoundHandler()}).ServeHTTP(w, req)
+
+	return w
+}
+
+func TestServeLsRefs(t *testing.T) {
+	repo, gitDir := testServer(t)
+	main := testGit(t, gitDir, "rev-parse", "main")
+	v2 := testGit(t, gitDir, "rev-parse", "v2")
+	v2Peeled := testGit(t, gitDir, "rev-parse", "v2^{}")
+
+	for n, test := range [...]struct {
+		Args     []string
+		Expected []string
+	}{
+		{ // 1
+			Expected: strings.Split(testGit(t, gitDir, "show-ref", "--head"), "\n"),
+		},
+		{ // 2
+			Args: []string{"symrefs", "ref-prefix HEAD", "ref-prefix refs/heads/main"},
+			Expected: []string{
+				main + " HEAD symref-target:refs/heads/main",
+				main + " refs/heads/main",
+			},
+		},
+		{ // 3
+			Args:     []string{"peel", "ref-prefix refs/tags/v2"},
+			Expected: []string{v2 + " refs/tags/v2 peeled:" + v2Peeled},
+		},
+	} {
+		req := pktLine("command=ls-refs\n") + "0001"
+
+		for _, arg := range test.Args {
+			req += pktLine(arg + "\n")
+		}
+
+		w := testUploadPack(t, repo, strings.NewReader(req+"0000"), false)
+		br := bufio.NewReader(w.Body)
+
+		var lines []string
+
+		for {
+			line, size, err := readPkt(br)
+			if err != nil {
+				t.Fatalf("test %d: unexpected error: %s", n+1, err)
+			} else if size == pktFlush {
+				break
+			}
+
+			lines = append(lines, line)
+		}
+
+		if !reflect.DeepEqual(lines, test.Expected) {
+			t.Errorf("test %d: expecting refs %q, got %q", n+1, test.Expected, lines)
+		}
+	}
+}
+
+func TestServeFetch(t *testing.T) {
+	repo, gitDir := testServer(t)
+	main := testGit(t, gitDir, "rev-parse", "main")
+	v1 := testGit(t, gitDir, "rev-parse", "v1")
+
+	for n, test := range [...]struct {
+		Args    []string
+		Gzip    bool
+		Objects string
+		Lines   []string
+	}{
+		{ // 1
+			Args:    []string{"want " + main, "done"},
+			Objects: main,
+			Lines:   []string{"packfile"},
+		},
+		{ // 2
+			Args:    []string{"want " + main, "have " + v1, "done"},
+			Gzip:    true,
+			Objects: main + " ^" + v1,
+			Lines:   []string{"packfile"},
+		},
+		{ // 3
+			Args:  []string{"want " + main, "have " + testID1},
+			Lines: []string{"acknowledgments", "NAK"},
+		},
+		{ // 4
+			Args:    []string{"want " + main, "have " + v1, "have " + testID1},
+			Objects: main + " ^" + v1,
+			Lines:   []string{"acknowledgments", "ACK " + v1, "ready", "", "packfile"},
+		},
+		{ // 5
+			Args:  []string{"want " + testID1, "done"},
+			Lines: []string{"ERR upload-pack: not our ref " + testID1},
+		},
+		{ // 6
+			Args:  []string{"want " + main, "have a", "done"},
+			Lines: []string{"ERR upload-pack: invalid object ID \"a\""},
+		},
+		{ // 7
+			Args:  []string{"want " + main, "have " + strings.ToUpper(v1)},
+			Lines: []string{"ERR upload-pack: invalid object ID \"" + strings.ToUpper(v1) + "\""},
+		},
+		{ // 8
+			Args:  []string{"want " + main[:39], "done"},
+			Lines: []string{"ERR upload-pack: invalid object ID \"" + main[:39] + "\""},
+		},
+	} {
+		req := pktLine("command=fetch\n") + "0001"
+
+		for _, arg := range test.Args {
+			req += pktLine(arg + "\n")
+		}
+
+		var body bytes.Buffer
+
+		if test.Gzip {
+			z := gzip.NewWriter(&body)
+
+			io.WriteString(z, req+"0000")
+			z.Close()
+		} else {
+			body.WriteString(req + "0000")
+		}
+
+		br := bufio.NewReader(testUploadPack(t, repo, &body, test.Gzip).Body)
+
+		var (
+			lines []string
+			pack  []byte
+		)
+
+		for {
+			line, size, err := readPkt(br)
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("test %d: unexpected error: %s", n+1, err)
+			} else if size == pktFlush {
+				break
+			} else if size == pktDelim {
+				lines = append(lines, "")
+			} else if len(lines) > 0 && lines[len(lines)-1] == "packfile" {
+				if line[0] != bandData {
+					t.Fatalf("test %d: unexpected band %d: %s", n+1, line[0], line[1:])
+				}
+
+				pack = append(pack, line[1:]...)
+			} else {
+				lines = append(lines, line)
+			}
+		}
+
+		if !reflect.DeepEqual(lines, test.Lines) {
+			t.Errorf("test %d: expecting lines %q, got %q", n+1, test.Lines, lines)
+		}
+
+		if test.Objects == "" {
+			continue
+		}
+
+		expected := strings.Fields(testGit(t, gitDir, append([]string{"rev-list", "--objects", "--no-object-names"}, strings.Fields(test.Objects)...)...))
+
+		if len(pack) < 12 || string(pack[:4]) != "PACK" {
+			t.Errorf("test %d: invalid pack", n+1)
+		} else if count := binary.BigEndian.Uint32(pack[8:12]); int(count) != len(expected) {
+			t.Errorf("test %d: expecting %d objects, got %d", n+1, len(expected), count)
+		}
+	}
+}
+
+func TestServeTooLarge(t *testing.T) {
+	repo, _ := testServer(t)
+	line := pktLine("have " + testID1 + "\n")
+	req := pktLine("command=fetch\n") + "0001" + strings.Repeat(line, maxRequest/len(line)+1) + "0000"
+
+	if w := testUploadPack(t, repo, strings.NewReader(req), false); w.Code != http.StatusBadRequest {
+		t.Errorf("expecting status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	var buf bytes.Buffer
+
+	z := gzip.NewWriter(&buf)
+
+	io.WriteString(z, req)
+	z.Close()
+
+	if buf.Len() >= maxRequest {
+		t.Fatalf("expecting compressed request to be smaller than %d bytes, got %d", maxRequest, buf.Len())
+	}
+
+	if w := testUploadPack(t, repo, &buf, true); w.Code != http.StatusBadRequest {
+		t.Errorf("expecting status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestServeClone(t *testing.T) {
+	repo, gitDir := testServer(t)
+
+	s := httptest.NewServer(&server{files: http.NotFoundHandler()})
+	defer s.Close()
+
+	clone := filepath.Join(t.TempDir(), "clone")
+
+	cmd := exec.Command("git", "-c", "protocol.version=2", "clone", "-q", "--mirror", s.URL+"/"+repo+".git", clone)
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_TERMINAL_PROMPT=0")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git clone failed: %s\n%s", err, out)
+	}
+
+	testGit(t, clone, "fsck", "--strict")
+
+	if refs, expected := testGit(t, clone, "show-ref", "--head"), testGit(t, gitDir, "show-ref", "--head"); refs != expected {
+		t.Errorf("expecting cloned refs:\n%s\ngot:\n%s", expected, refs)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func snapshotPath(id string) string {
+	return "tree/" + id + "/"
+}
+
+// snapshotCommits returns the commits whose trees should be rendered, keyed
+// by commit ID. The log is the full history of the repo, which is only used
+// when snapshotting every commit.
+func snapshotCommits(tags []*Tag, log []*Commit) map[string]*Commit {
+	commits := make(map[string]*Commit)
+
+	if config.SnapshotTags {
+		for _, tag := range tags {
+			commits[tag.Commit.ID] = tag.Commit
+		}
+	}
+
+	if config.SnapshotCommits {
+		for _, c := range log {
+			commits[c.ID] = c
+		}
+	}
+
+	return commits
+}
+
+// pendingSnapshots returns the commits that do not yet have a complete
+// snapshot, oldest first. As a snapshot is only ever the tree of a single
+// commit, a snapshot with an index is never rebuilt unless forced.
+func pendingSnapshots(repo string, commits map[string]*Commit) ([]*Commit, error) {
+	var pending []*Commit
+
+	for id, c := range commits {
+		if !force {
+			_, err := os.Stat(filepath.Join(config.OutputDir, repo, filepath.FromSlash(snapshotPath(id)), "index.html"))
+			if err == nil {
+				continue
+			} else if !os.IsNotExist(err) {
+				return nil, fmt.Errorf("error stat'ing snapshot index: %w", err)
+			}
+		}
+
+		pending = append(pending, c)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		if ti, tj := pending[i].Time, pending[j].Time; !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+
+		return pending[i].ID < pending[j].ID
+	})
+
+	return pending, nil
+}
+
+// removeSnapshots removes the snapshots of any commits that are no longer
+// wanted, such as those of deleted tags.
+func removeSnapshots(repo string, commits map[string]*Commit) error {
+	dir := filepath.Join(config.OutputDir, repo, "tree")
+
+	snapshots, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading snapshot directory: %w", err)
+	}
+
+	for _, s := range snapshots {
+		if _, ok := commits[s.Name()]; !ok {
+			if err := os.RemoveAll(filepath.Join(dir, s.Name())); err != nil {
+				return fmt.Errorf("error removing snapshot: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func buildSnapshots(t *treeBuilder, pending []*Commit, tags []*Tag) error {
+	commitTags := make(map[string][]*Tag)
+
+	for _, tag := range tags {
+		commitTags[tag.Commit.ID] = append(commitTags[tag.Commit.ID], tag)
+	}
+
+	memo := make(map[string]*lastCommit)
+
+	for _, c := range pending {
+		base := filepath.Join(config.OutputDir, t.repo, filepath.FromSlash(snapshotPath(c.ID)))
+
+		tree, err := t.r.GetTree(c.Tree)
+		if err != nil {
+			return fmt.Errorf("error reading tree: %w", err)
+		}
+
+		last, err := t.r.lastCommitsFrom(c, memo)
+		if err != nil {
+			return fmt.Errorf("error reading last commits: %w", err)
+		}
+
+		st := &treeBuilder{
+			repo:     t.repo,
+			r:        t.r,
+			base:     base,
+			rendered: t.rendered,
+			sizes:    t.sizes,
+			keys:     make(map[string]struct{}),
+		}
+
+		d, err := st.parseTree(c.Tree, tree, last, []string{})
+		if err != nil {
+			return err
+		}
+
+		if err := st.writeStoreRefs(); err != nil {
+			return err
+		}
+
+		if err := writeRepoIndex(filepath.Join(base, "index.html"), RepoInfo{
+			Name:   t.repo,
+			Desc:   t.r.GetDescription(),
+			Root:   d,
+			Commit: c,
+			Tags:   commitTags[c.ID],
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
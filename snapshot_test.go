@@ -0,0 +1,127 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func commitNames(commits []*Commit) []string {
+	var names []string
+
+	for _, c := range commits {
+		names = append(names, c.Msg)
+	}
+
+	return names
+}
+
+func TestBuildSnapshots(t *testing.T) {
+	gitDir, ids := testTagRepo(t)
+	saved := config
+
+	defer func() { config = saved }()
+
+	config.OutputDir = t.TempDir()
+	config.repoTemplate = template.Must(template.New("repo").Parse("{{.Commit.Msg}}{{range .Tags}} {{.Name}}{{end}} {{.Root.FileCount}}"))
+	r := OpenRepo(gitDir)
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	log, err := r.walkLog(ids["c7"])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for n, test := range [...]struct {
+		Tags, Commits bool
+		Expected      []string
+	}{
+		{ // 1
+		},
+		{ // 2
+			Tags:     true,
+			Expected: []string{"c1", "c3", "c4"},
+		},
+		{ // 3
+			Commits:  true,
+			Expected: []string{"c1", "c2", "c3", "c4", "c5", "c6", "c7"},
+		},
+		{ // 4
+			Tags:     true,
+			Commits:  true,
+			Expected: []string{"c1", "c2", "c3", "c4", "c5", "c6", "c7"},
+		},
+	} {
+		config.SnapshotTags = test.Tags
+		config.SnapshotCommits = test.Commits
+
+		pending, err := pendingSnapshots("repo", snapshotCommits(tags, log))
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if got := commitNames(pending); !reflect.DeepEqual(got, test.Expected) {
+			t.Errorf("test %d: expecting snapshots %v, got %v", n+1, test.Expected, got)
+		}
+	}
+
+	config.SnapshotTags = true
+	config.SnapshotCommits = false
+	base := filepath.Join(config.OutputDir, "repo")
+	commits := snapshotCommits(tags, log)
+
+	writeFiles(t, base, map[string]string{snapshotPath(testID1) + "index.html": "old"})
+
+	if err := removeSnapshots("repo", commits); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if fileExists(filepath.Join(base, filepath.FromSlash(snapshotPath(testID1)))) {
+		t.Error("expecting snapshot of an unwanted commit to be removed")
+	}
+
+	pending, err := pendingSnapshots("repo", commits)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	b := testTreeBuilder(r, "repo")
+
+	if err := buildSnapshots(b, pending, tags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for p, expected := range map[string]string{
+		snapshotPath(ids["c1"]) + "index.html":          "c1 v1 3",
+		snapshotPath(ids["c3"]) + "index.html":          "c3 side 3",
+		snapshotPath(ids["c4"]) + "index.html":          "c4 v2 v3 2",
+		snapshotPath(ids["c1"]) + "files/b.txt":         "b\n",
+		snapshotPath(ids["c3"]) + "files/dir/moved.txt": "b\n",
+		snapshotPath(ids["c4"]) + "files/a.txt":         "1\nX\n3\n4\n",
+	} {
+		if data, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(p))); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if string(data) != expected {
+			t.Errorf("expecting %s to be %q, got %q", p, expected, data)
+		}
+	}
+
+	a, errA := os.Stat(filepath.Join(base, filepath.FromSlash(snapshotPath(ids["c1"])+"files/b.txt")))
+	c, errC := os.Stat(filepath.Join(base, filepath.FromSlash(snapshotPath(ids["c3"])+"files/dir/moved.txt")))
+
+	if errA != nil || errC != nil {
+		t.Errorf("unexpected errors: %v, %v", errA, errC)
+	} else if !os.SameFile(a, c) {
+		t.Error("expecting snapshots of the same blob to share a stored file")
+	}
+
+	if pending, err := pendingSnapshots("repo", commits); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if len(pending) != 0 {
+		t.Errorf("expecting no pending snapshots after building, got %v", commitNames(pending))
+	}
+}
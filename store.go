@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"vimagination.zapto.org/memio"
+	"vimagination.zapto.org/parser"
+)
+
+const storeRefsDir = "refs"
+
+func storePath(key string) string {
+	return filepath.Join(config.OutputDir, config.StoreDir, key[:2], key[2:])
+}
+
+// storeRefsPath returns the path of the list of store keys used by the output
+// tree at base.
+func storeRefsPath(base string) (string, error) {
+	rel, err := filepath.Rel(config.OutputDir, base)
+	if err != nil {
+		return "", fmt.Errorf("error finding store refs path: %w", err)
+	}
+
+	return filepath.Join(config.OutputDir, config.StoreDir, storeRefsDir, rel+".keys"), nil
+}
+
+// storeKey identifies the rendered output of a file. Unprinted files are
+// keyed only by their blob ID, whereas pretty printed files also depend on
+// everything about the file that is visible to the pretty print template.
+func storeKey(file *File, id string, printer parser.TokenFunc, blame bool) string {
+	if printer == nil {
+		return id
+	}
+
+	h := sha1.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%t", id, file.Ext, file.Repo, file.Path, file.Commit.ID, file.History, config.RawDir, blame)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// store renders the output for the given key into the shared store, if it
+// isn't already there, and links it into place at outpath.
+func (t *treeBuilder) store(key, outpath string, ct time.Time, render func(io.Writer) error) error {
+	stored := storePath(key)
+
+	sfi, err := os.Stat(stored)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error stat'ing stored file: %w", err)
+	}
+
+	if _, ok := t.rendered[key]; !ok && (err != nil || force) {
+		if err := os.MkdirAll(filepath.Dir(stored), 0o755); err != nil {
+			return fmt.Errorf("error creating store directory: %w", err)
+		}
+
+		tmp := stored + ".tmp"
+
+		f, err := os.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("error creating stored file: %w", err)
+		}
+
+		if err := render(f); err != nil {
+			f.Close()
+			os.Remove(tmp)
+
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("error closing stored file: %w", err)
+		}
+
+		if err := os.Chtimes(tmp, ct, ct); err != nil {
+			return fmt.Errorf("error setting stored file time: %w", err)
+		}
+
+		if err := os.Rename(tmp, stored); err != nil {
+			return fmt.Errorf("error moving stored file: %w", err)
+		}
+
+		if sfi, err = os.Stat(stored); err != nil {
+			return fmt.Errorf("error stat'ing stored file: %w", err)
+		}
+	}
+
+	t.rendered[key] = struct{}{}
+	t.keys[key] = struct{}{}
+
+	fi, err := os.Lstat(outpath)
+	if err == nil {
+		if os.SameFile(fi, sfi) || !force && fi.Mode().IsRegular() && fi.Size() == sfi.Size() && fi.ModTime().Equal(sfi.ModTime()) {
+			return nil
+		}
+
+		if err := os.RemoveAll(outpath); err != nil {
+			return fmt.Errorf("error removing file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error while stat'ing file: %w", err)
+	}
+
+	if err := os.Link(stored, outpath); err == nil {
+		return nil
+	}
+
+	if err := copyFile(stored, outpath); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(outpath, sfi.ModTime(), sfi.ModTime()); err != nil {
+		return fmt.Errorf("error setting file time: %w", err)
+	}
+
+	return nil
+}
+
+func (t *treeBuilder) blobSize(id string) (int64, error) {
+	if size, ok := t.sizes[id]; ok {
+		return size, nil
+	}
+
+	b, err := t.r.GetBlob(id)
+	if err != nil {
+		return 0, fmt.Errorf("error getting file data: %w", err)
+	}
+
+	var size int64
+
+	if m, ok := b.(*memio.LimitedBuffer); ok {
+		size = int64(len(*m))
+	} else {
+		size, err = io.Copy(io.Discard, b)
+	}
+
+	b.Close()
+
+	if err != nil {
+		return 0, fmt.Errorf("error reading file data: %w", err)
+	}
+
+	t.sizes[id] = size
+
+	return size, nil
+}
+
+func (t *treeBuilder) writeFile(file *File, id, outpath string, printer parser.TokenFunc) error {
+	size, err := t.blobSize(id)
+	if err != nil {
+		return err
+	}
+
+	file.Size = size
+	blame := printer != nil && config.Blame && t.histories != nil
+
+	return t.store(storeKey(file, id, printer, blame), outpath, file.Commit.Time, func(w io.Writer) error {
+		b, err := t.r.GetBlob(id)
+		if err != nil {
+			return fmt.Errorf("error getting file data: %w", err)
+		}
+
+		defer b.Close()
+
+		if blame {
+			if file.Blame, err = t.r.blame(t.histories[file.Path]); err != nil {
+				return fmt.Errorf("error reading blame: %w", err)
+			}
+		}
+
+		if _, err = prettify(file, w, b, printer); err != nil {
+			return fmt.Errorf("error writing file data: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (t *treeBuilder) writeRaw(id, outpath string, ct time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(outpath), 0o755); err != nil {
+		return fmt.Errorf("error creating raw file directory: %w", err)
+	}
+
+	return t.store(id, outpath, ct, func(w io.Writer) error {
+		b, err := t.r.GetBlob(id)
+		if err != nil {
+			return fmt.Errorf("error getting file data: %w", err)
+		}
+
+		_, err = io.Copy(w, b)
+
+		b.Close()
+
+		if err != nil {
+			return fmt.Errorf("error writing raw file: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// createOutput creates the file at path for writing, removing any existing
+// file first, as it may be linked to a file in the store, which would otherwise
+// be truncated.
+func createOutput(path string) (*os.File, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("error opening stored file: %w", err)
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return fmt.Errorf("error creating data file: %w", err)
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+
+		return fmt.Errorf("error copying stored file: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing file: %w", err)
+	}
+
+	return nil
+}
+
+// writeStoreRefs records the store keys used by the output tree, so that
+// pruneStore keeps them.
+func (t *treeBuilder) writeStoreRefs() error {
+	path, err := storeRefsPath(t.base)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(t.keys))
+
+	for key := range t.keys {
+		keys = append(keys, key+"\n")
+	}
+
+	sort.Strings(keys)
+
+	return writeIfChanged(path, []byte(strings.Join(keys, "")))
+}
+
+// readStoreRefs returns the keys recorded by writeStoreRefs for all output
+// trees that still exist, removing the lists of those that don't.
+func readStoreRefs() (map[string]struct{}, error) {
+	refsDir := filepath.Join(config.OutputDir, config.StoreDir, storeRefsDir)
+	keys := make(map[string]struct{})
+
+	return keys, filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		} else if d.IsDir() || !strings.HasSuffix(path, ".keys") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(refsDir, strings.TrimSuffix(path, ".keys"))
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(filepath.Join(config.OutputDir, rel)); os.IsNotExist(err) {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing store refs: %w", err)
+			}
+
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening store refs: %w", err)
+		}
+
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+
+		for s.Scan() {
+			keys[s.Text()] = struct{}{}
+		}
+
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("error reading store refs: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// pruneStore removes any stored files that are no longer used by any output
+// tree.
+func pruneStore() error {
+	keys, err := readStoreRefs()
+	if err != nil {
+		return err
+	}
+
+	storeDir := filepath.Join(config.OutputDir, config.StoreDir)
+
+	return filepath.WalkDir(storeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		} else if d.IsDir() {
+			if path == filepath.Join(storeDir, storeRefsDir) {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		dir, name := filepath.Split(path)
+
+		if _, ok := keys[filepath.Base(dir)+name]; !ok {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("error removing stored file: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPruneStore(t *testing.T) {
+	saved := config
+
+	defer func() { config = saved }()
+
+	for n, test := range [...]struct {
+		Files, Remaining []string
+	}{
+		{ // 1
+			Files: []string{
+				".store/11/11",
+				".store/22/22",
+			},
+		},
+		{ // 2
+			Files: []string{
+				"repo/index.html",
+				".store/refs/repo.keys:1111\n",
+				".store/11/11",
+				".store/22/22",
+				".store/22/22.tmp",
+			},
+			Remaining: []string{
+				".store/11/11",
+				".store/refs/repo.keys",
+				"repo/index.html",
+			},
+		},
+		{ // 3
+			Files: []string{
+				"repo/index.html",
+				"repo/tree/abc/index.html",
+				".store/refs/repo.keys:1111\n",
+				".store/refs/repo/tree/abc.keys:2222\n",
+				".store/refs/repo/tree/def.keys:3333\n",
+				".store/refs/other.keys:1111\n3333\n",
+				".store/11/11",
+				".store/22/22",
+				".store/33/33",
+			},
+			Remaining: []string{
+				".store/11/11",
+				".store/22/22",
+				".store/refs/repo.keys",
+				".store/refs/repo/tree/abc.keys",
+				"repo/index.html",
+				"repo/tree/abc/index.html",
+			},
+		},
+	} {
+		dir := t.TempDir()
+		config.OutputDir = dir
+		config.StoreDir = ".store"
+
+		files := make(map[string]string, len(test.Files))
+
+		for _, f := range test.Files {
+			name, contents, _ := strings.Cut(f, ":")
+			files[name] = contents
+		}
+
+		writeFiles(t, dir, files)
+
+		if err := pruneStore(); err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+
+			continue
+		}
+
+		var remaining []string
+
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				rel, _ := filepath.Rel(dir, path)
+				remaining = append(remaining, filepath.ToSlash(rel))
+			}
+
+			return err
+		})
+
+		sort.Strings(remaining)
+
+		if !reflect.DeepEqual(remaining, test.Remaining) {
+			t.Errorf("test %d: expecting remaining files %v, got %v", n+1, test.Remaining, remaining)
+		}
+	}
+}
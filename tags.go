@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"vimagination.zapto.org/memio"
+)
+
+type Tag struct {
+	ID, Name, Object, Msg string
+	Type                  int
+	Tagger, TaggerEmail   string
+	Time                  time.Time
+	Commit                *Commit
+}
+
+func (t *Tag) Subject() string {
+	if p := strings.IndexByte(t.Msg, '\n'); p >= 0 {
+		return t.Msg[:p]
+	}
+
+	return t.Msg
+}
+
+func (r *Repo) GetTag(id string) (*Tag, error) {
+	r.cacheMu.RLock()
+	to, ok := r.cache[id]
+	r.cacheMu.RUnlock()
+
+	if ok {
+		if t, ok := to.(*Tag); ok {
+			return t, nil
+		}
+
+		return nil, errors.New("wrong type")
+	}
+
+	o, err := r.getObject(id, ObjectTag)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening tag object: %w", err)
+	}
+
+	var buf []byte
+
+	if m, ok := o.(*memio.LimitedBuffer); ok {
+		buf = *m
+	} else {
+		buf, err = io.ReadAll(o)
+
+		o.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading tag: %w", err)
+		}
+	}
+
+	t := &Tag{ID: id}
+
+	for {
+		p := bytes.IndexByte(buf, '\n')
+		if p < 0 {
+			buf = nil
+
+			break
+		}
+
+		line := buf[:p]
+		buf = buf[p+1:]
+
+		if p == 0 {
+			break
+		}
+
+		if p > 7 && string(line[:7]) == "object " {
+			if t.Object = checkSHA(line[7:]); t.Object == "" {
+				return nil, errors.New("invalid object SHA")
+			}
+		} else if p > 5 && string(line[:5]) == "type " {
+			for typ, header := range objectHeaders {
+				if header != "" && header[:len(header)-1] == string(line[5:]) {
+					t.Type = typ
+				}
+			}
+		} else if p > 4 && string(line[:4]) == "tag " {
+			t.Name = string(line[4:])
+		} else if p > 7 && string(line[:7]) == "tagger " {
+			if t.Tagger, t.TaggerEmail, t.Time, err = parseSignature(line[7:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if t.Object == "" || t.Type == 0 {
+		return nil, errors.New("invalid tag")
+	}
+
+	t.Msg = strings.TrimSuffix(string(buf), "\n")
+
+	r.cacheMu.Lock()
+	r.cache[id] = t
+	r.cacheMu.Unlock()
+
+	return t, nil
+}
+
+// Tags returns all of the tags in the repository that point, either directly
+// or through annotated tags, to a commit, newest commit first.
+func (r *Repo) Tags() ([]*Tag, error) {
+	const tagPrefix = "refs/tags/"
+
+	refs, err := r.listRefs(tagPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tag refs: %w", err)
+	}
+
+	tags := make([]*Tag, 0, len(refs))
+
+	for name, id := range refs {
+		peeled, t, err := r.peel(id)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tag %s: %w", name, err)
+		}
+
+		if typ, err := r.ObjectType(peeled); err != nil {
+			return nil, fmt.Errorf("error reading tag %s: %w", name, err)
+		} else if typ != ObjectCommit {
+			continue
+		}
+
+		tag := &Tag{Object: id, Type: ObjectCommit}
+
+		if t != nil {
+			*tag = *t
+		}
+
+		tag.Name = name[len(tagPrefix):]
+
+		if tag.Commit, err = r.GetCommit(peeled); err != nil {
+			return nil, fmt.Errorf("error reading tag %s: %w", name, err)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if ti, tj := tags[i].Commit.Time, tags[j].Commit.Time; !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
+
+// peel follows annotated tags from the given object to the object they
+// ultimately point to, returning its ID and the outermost tag, which is nil
+// when the given object isn't a tag.
+func (r *Repo) peel(id string) (string, *Tag, error) {
+	var outer *Tag
+
+	for n := 0; n <= 10; n++ {
+		typ, err := r.ObjectType(id)
+		if err != nil {
+			return "", nil, err
+		} else if typ != ObjectTag {
+			return id, outer, nil
+		}
+
+		t, err := r.GetTag(id)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if outer == nil {
+			outer = t
+		}
+
+		id = t.Object
+	}
+
+	return "", nil, errors.New("too many nested tags")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTagRepo adds tags to the repo from testHistoryRepo: v1, a lightweight tag
+// of c1; side, a lightweight tag of c3; v2, an annotated tag of c4; v3, an
+// annotated tag of v2; and tree, a lightweight tag of the tree of c7.
+func testTagRepo(t *testing.T) (string, map[string]string) {
+	t.Helper()
+
+	gitDir, ids := testHistoryRepo(t)
+
+	testGit(t, gitDir, "tag", "v1", ids["c1"])
+	testGit(t, gitDir, "tag", "side", ids["c3"])
+	testGit(t, gitDir, "tag", "-a", "-m", "version 2\n\nmore", "v2", ids["c4"])
+	testGit(t, gitDir, "tag", "-a", "-m", "outer", "v3", "v2")
+	testGit(t, gitDir, "tag", "tree", ids["c7"]+"^{tree}")
+
+	ids["v2"] = testGit(t, gitDir, "rev-parse", "v2")
+	ids["v3"] = testGit(t, gitDir, "rev-parse", "v3")
+
+	return gitDir, ids
+}
+
+func TestTags(t *testing.T) {
+	gitDir, ids := testTagRepo(t)
+	r := OpenRepo(gitDir)
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tagTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for n, test := range [...]struct {
+		Commit string
+		Tag    Tag
+	}{
+		{ // 1
+			Commit: "c4",
+			Tag:    Tag{ID: ids["v2"], Name: "v2", Object: ids["c4"], Msg: "version 2\n\nmore", Type: ObjectCommit, Tagger: "Committer", TaggerEmail: "committer@example.com", Time: tagTime},
+		},
+		{ // 2
+			Commit: "c4",
+			Tag:    Tag{ID: ids["v3"], Name: "v3", Object: ids["v2"], Msg: "outer", Type: ObjectTag, Tagger: "Committer", TaggerEmail: "committer@example.com", Time: tagTime},
+		},
+		{ // 3
+			Commit: "c3",
+			Tag:    Tag{Name: "side", Object: ids["c3"], Type: ObjectCommit},
+		},
+		{ // 4
+			Commit: "c1",
+			Tag:    Tag{Name: "v1", Object: ids["c1"], Type: ObjectCommit},
+		},
+	} {
+		if n >= len(tags) {
+			t.Errorf("test %d: missing tag %s", n+1, test.Tag.Name)
+
+			continue
+		}
+
+		tag := *tags[n]
+
+		if tag.Commit == nil || tag.Commit.ID != ids[test.Commit] {
+			t.Errorf("test %d: expecting tag %s to point to %s, got %v", n+1, tag.Name, test.Commit, tag.Commit)
+		}
+
+		if !tag.Time.Equal(test.Tag.Time) {
+			t.Errorf("test %d: expecting time %s, got %s", n+1, test.Tag.Time, tag.Time)
+		}
+
+		tag.Commit = nil
+		tag.Time = test.Tag.Time
+
+		if !reflect.DeepEqual(tag, test.Tag) {
+			t.Errorf("test %d: expecting tag %+v, got %+v", n+1, test.Tag, tag)
+		}
+	}
+
+	if len(tags) != 4 {
+		t.Errorf("expecting 4 tags, got %d", len(tags))
+	} else if tags[0].Subject() != "version 2" {
+		t.Errorf("expecting subject %q, got %q", "version 2", tags[0].Subject())
+	}
+}
+
+func TestGetTag(t *testing.T) {
+	gitDir, ids := testTagRepo(t)
+	r := OpenRepo(gitDir)
+
+	tag, err := r.GetTag(ids["v2"])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if tag.Name != "v2" || tag.Object != ids["c4"] || tag.Type != ObjectCommit || tag.Msg != "version 2\n\nmore" || tag.Commit != nil {
+		t.Errorf("unexpected tag: %+v", tag)
+	}
+
+	if again, err := r.GetTag(ids["v2"]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if again != tag {
+		t.Error("expecting tag to be cached")
+	}
+
+	if _, err := r.GetTag(ids["c1"]); err == nil {
+		t.Error("expecting error reading a commit as a tag, got nil")
+	}
+
+	if _, err := r.GetTag(testID1); err == nil {
+		t.Error("expecting error reading a missing tag, got nil")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ChangeType uint8
+
+const (
+	ChangeAdded ChangeType = iota
+	ChangeDeleted
+	ChangeModified
+	ChangeTypeChanged
+	ChangeRenamed
+	ChangeCopied
+)
+
+var changeTypeNames = [...]string{
+	"added",
+	"deleted",
+	"modified",
+	"typechanged",
+	"renamed",
+	"copied",
+}
+
+func (c ChangeType) String() string {
+	if int(c) < len(changeTypeNames) {
+		return changeTypeNames[c]
+	}
+
+	return "unknown"
+}
+
+type EntryType uint8
+
+const (
+	EntryFile EntryType = iota
+	EntryDir
+	EntrySymlink
+)
+
+func splitEntryName(name string) (string, EntryType) {
+	if name[len(name)-1] == '/' {
+		return name[:len(name)-1], EntryDir
+	} else if name[0] == '/' {
+		return name[1:], EntrySymlink
+	}
+
+	return name, EntryFile
+}
+
+type Change struct {
+	Type             ChangeType
+	Path, OldPath    string
+	OldID, NewID     string
+	OldType, NewType EntryType
+	Similarity       int
+}
+
+type treeEntry struct {
+	id  string
+	typ EntryType
+}
+
+type entryPair struct {
+	old, new *treeEntry
+}
+
+// DiffTrees recursively compares the two trees, returning the changed
+// non-directory paths in the same order as git diff-tree, which sorts the
+// entries of each tree with a "/" appended to the names of directories. An
+// empty tree ID represents an empty tree.
+func (r *Repo) DiffTrees(from, to string) ([]Change, error) {
+	var changes []Change
+
+	if err := r.diffTrees(from, to, "", &changes); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func (r *Repo) readTreeEntries(id string, pairs map[string]*entryPair, old bool) error {
+	if id == "" {
+		return nil
+	}
+
+	t, err := r.GetTree(id)
+	if err != nil {
+		return fmt.Errorf("error reading tree: %w", err)
+	}
+
+	for name, oid := range t {
+		name, typ := splitEntryName(name)
+
+		// a directory and a file of the same name are separate entries, with
+		// the directory sorting as though it were named with a trailing "/"
+		if typ == EntryDir {
+			name += "/"
+		}
+
+		p, ok := pairs[name]
+		if !ok {
+			p = new(entryPair)
+			pairs[name] = p
+		}
+
+		if old {
+			p.old = &treeEntry{id: oid, typ: typ}
+		} else {
+			p.new = &treeEntry{id: oid, typ: typ}
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) diffTrees(from, to, base string, changes *[]Change) error {
+	if from == to {
+		return nil
+	}
+
+	pairs := make(map[string]*entryPair)
+
+	if err := r.readTreeEntries(from, pairs, true); err != nil {
+		return err
+	}
+
+	if err := r.readTreeEntries(to, pairs, false); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(pairs))
+
+	for name := range pairs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := pairs[name]
+		path := base + strings.TrimSuffix(name, "/")
+
+		if p.old != nil && p.new != nil && p.old.typ == EntryDir {
+			if err := r.diffTrees(p.old.id, p.new.id, path+"/", changes); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if p.old != nil && p.new != nil {
+			if p.old.id == p.new.id && p.old.typ == p.new.typ {
+				continue
+			}
+
+			typ := ChangeModified
+
+			if p.old.typ != p.new.typ {
+				typ = ChangeTypeChanged
+			}
+
+			*changes = append(*changes, Change{
+				Type:    typ,
+				Path:    path,
+				OldID:   p.old.id,
+				NewID:   p.new.id,
+				OldType: p.old.typ,
+				NewType: p.new.typ,
+			})
+
+			continue
+		}
+
+		e, typ := p.new, ChangeAdded
+
+		if e == nil {
+			e, typ = p.old, ChangeDeleted
+		}
+
+		if err := r.entryChanges(e, path, typ, changes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) entryChanges(e *treeEntry, path string, typ ChangeType, changes *[]Change) error {
+	if e.typ == EntryDir {
+		if typ == ChangeAdded {
+			return r.diffTrees("", e.id, path+"/", changes)
+		}
+
+		return r.diffTrees(e.id, "", path+"/", changes)
+	}
+
+	c := Change{
+		Type: typ,
+		Path: path,
+	}
+
+	if typ == ChangeAdded {
+		c.NewID = e.id
+		c.NewType = e.typ
+	} else {
+		c.OldID = e.id
+		c.OldType = e.typ
+	}
+
+	*changes = append(*changes, c)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// testObject writes a loose object to the git directory, returning its ID.
+func testObject(t *testing.T, dir string, typ int, data string) string {
+	t.Helper()
+
+	raw := objectHeaders[typ] + strconv.Itoa(len(data)) + "\x00" + data
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(raw)))
+	path := filepath.Join(dir, "objects", id[:2], id[2:])
+
+	var buf bytes.Buffer
+
+	z := zlib.NewWriter(&buf)
+
+	z.Write([]byte(raw))
+	z.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0o444); err != nil && !os.IsPermission(err) {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// testTree writes a tree object containing the given entries, which are named
+// with a trailing slash for directories and a leading slash for symlinks.
+func testTree(t *testing.T, dir string, entries map[string]string) string {
+	t.Helper()
+
+	names := make([]string, 0, len(entries))
+
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sortName := func(name string) string {
+		if name[0] == '/' {
+			return name[1:]
+		}
+
+		return name
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return sortName(names[i]) < sortName(names[j])
+	})
+
+	var buf bytes.Buffer
+
+	for _, name := range names {
+		mode := "100644 "
+
+		if name[len(name)-1] == '/' {
+			mode = "40000 "
+		} else if name[0] == '/' {
+			mode = "120000 "
+		}
+
+		id, _ := hex.DecodeString(entries[name])
+
+		buf.WriteString(mode + splitName(name) + "\x00")
+		buf.Write(id)
+	}
+
+	return testObject(t, dir, ObjectTree, buf.String())
+}
+
+func splitName(name string) string {
+	name, _ = splitEntryName(name)
+
+	return name
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	a := testObject(t, dir, ObjectBlob, "a\n")
+	b := testObject(t, dir, ObjectBlob, "b\n")
+	c := testObject(t, dir, ObjectBlob, "c\n")
+	sub := testTree(t, dir, map[string]string{"x": a, "y": b})
+	sub2 := testTree(t, dir, map[string]string{"x": a, "y": c})
+	base := testTree(t, dir, map[string]string{"file": a, "link": b, "sub/": sub})
+
+	for n, test := range [...]struct {
+		From, To map[string]string
+		Changes  []Change
+	}{
+		{ // 1
+			From: map[string]string{"file": a},
+			To:   map[string]string{"file": a},
+		},
+		{ // 2
+			To: map[string]string{"file": a, "sub/": sub},
+			Changes: []Change{
+				{Type: ChangeAdded, Path: "file", NewID: a},
+				{Type: ChangeAdded, Path: "sub/x", NewID: a},
+				{Type: ChangeAdded, Path: "sub/y", NewID: b},
+			},
+		},
+		{ // 3
+			From: map[string]string{"file": a, "link": b, "sub/": sub},
+			To:   map[string]string{"file": c, "/link": b, "sub/": sub2},
+			Changes: []Change{
+				{Type: ChangeModified, Path: "file", OldID: a, NewID: c},
+				{Type: ChangeTypeChanged, Path: "link", OldID: b, NewID: b, NewType: EntrySymlink},
+				{Type: ChangeModified, Path: "sub/y", OldID: b, NewID: c},
+			},
+		},
+		{ // 4
+			From: map[string]string{"sub/": sub},
+			To:   map[string]string{"sub": c},
+			Changes: []Change{
+				{Type: ChangeAdded, Path: "sub", NewID: c},
+				{Type: ChangeDeleted, Path: "sub/x", OldID: a},
+				{Type: ChangeDeleted, Path: "sub/y", OldID: b},
+			},
+		},
+		{ // 5
+			From: map[string]string{"file": a, "link": b, "sub/": sub},
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "file", OldID: a},
+				{Type: ChangeDeleted, Path: "link", OldID: b},
+				{Type: ChangeDeleted, Path: "sub/x", OldID: a},
+				{Type: ChangeDeleted, Path: "sub/y", OldID: b},
+			},
+		},
+		{ // 6
+			From: map[string]string{"a.b": a, "a/": sub},
+			To:   map[string]string{"a.b": b, "a/": sub2, "a-": c},
+			Changes: []Change{
+				{Type: ChangeAdded, Path: "a-", NewID: c},
+				{Type: ChangeModified, Path: "a.b", OldID: a, NewID: b},
+				{Type: ChangeModified, Path: "a/y", OldID: b, NewID: c},
+			},
+		},
+		{ // 7
+			From: map[string]string{"a": a, "a.b": b},
+			To:   map[string]string{"a/": sub, "a.b": b},
+			Changes: []Change{
+				{Type: ChangeDeleted, Path: "a", OldID: a},
+				{Type: ChangeAdded, Path: "a/x", NewID: a},
+				{Type: ChangeAdded, Path: "a/y", NewID: b},
+			},
+		},
+	} {
+		var from, to string
+
+		if test.From != nil {
+			from = testTree(t, dir, test.From)
+		}
+
+		if test.To != nil {
+			to = testTree(t, dir, test.To)
+		}
+
+		changes, err := OpenRepo(dir).DiffTrees(from, to)
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", n+1, err)
+		} else if !reflect.DeepEqual(changes, test.Changes) {
+			t.Errorf("test %d: expecting changes %v, got %v", n+1, test.Changes, changes)
+		}
+	}
+
+	if changes, err := OpenRepo(dir).DiffTrees(base, base); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if len(changes) != 0 {
+		t.Errorf("expecting no changes between identical trees, got %v", changes)
+	}
+}